@@ -1,14 +1,16 @@
 package clog
 
 import (
-	//    "fmt"
+	"fmt"
 	"log"
 	"os"
+	"strings"
 	"sync"
 )
 
 var logMutex sync.Mutex
 var with_colors bool = true
+var min_level LogLevel = DEBUG
 
 type LogLevel uint
 
@@ -33,6 +35,27 @@ var plain_tags = [...]string{
 	"ERROR",
 }
 
+// ParseLevel converts a level name such as "info" or "warning" to a LogLevel.
+func ParseLevel(s string) (LogLevel, error) {
+	for i, name := range plain_tags {
+		if strings.EqualFold(s, name) {
+			return LogLevel(i), nil
+		}
+	}
+	if strings.EqualFold(s, "warn") {
+		return WARNING, nil
+	}
+	return DEBUG, fmt.Errorf("Unknown log level '%s', expected debug, info, warning or error", s)
+}
+
+// SetLevel discards messages below the given level.
+func SetLevel(level LogLevel) {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+
+	min_level = level
+}
+
 /*
 var logfile *os.File
 
@@ -61,6 +84,9 @@ func Log(level LogLevel, format string, v ...interface{}) {
 	logMutex.Lock()
 	defer logMutex.Unlock()
 
+	if level < min_level {
+		return
+	}
 	log.Printf(tag+format, v...)
 }
 
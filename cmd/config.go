@@ -0,0 +1,275 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"pannetrat.com/nocan/clog"
+	"pannetrat.com/nocan/models"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Config is the content of the YAML file given with --config. Settings given
+// on the command line take precedence over the ones of the file.
+type Config struct {
+	Listen         string            `yaml:"listen"`
+	DataDir        string            `yaml:"data_dir"`
+	StaticDir      string            `yaml:"static_dir"`
+	ViewDir        string            `yaml:"view_dir"`
+	LogLevel       string            `yaml:"log_level"`
+	Credentials    string            `yaml:"credentials"`
+	Timeouts       TimeoutConfig     `yaml:"timeouts"`
+	PowerOffOnExit bool              `yaml:"power_off_on_exit"`
+	Interfaces     []InterfaceConfig `yaml:"interfaces"`
+	Channels       []ChannelConfig   `yaml:"channels"`
+}
+
+type TimeoutConfig struct {
+	Default  time.Duration `yaml:"default"`
+	Extended time.Duration `yaml:"extended"`
+	Shutdown time.Duration `yaml:"shutdown"`
+}
+
+type InterfaceConfig struct {
+	Device      string `yaml:"device"`
+	PowerOn     *bool  `yaml:"power_on"`
+	Termination *bool  `yaml:"termination"`
+}
+
+type ChannelConfig struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+}
+
+func LoadConfig(filename string) (*Config, error) {
+	var config Config
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err = yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("YAML parsing error in %s: %s", filename, err.Error())
+	}
+	for i, itr := range config.Interfaces {
+		if itr.Device == "" {
+			return nil, fmt.Errorf("Interface %d in %s has no device", i+1, filename)
+		}
+	}
+	for i, itr := range config.Channels {
+		if itr.Name == "" {
+			return nil, fmt.Errorf("Channel %d in %s has no name", i+1, filename)
+		}
+		if itr.Type != "" {
+			if _, err := models.ParseChannelType(itr.Type); err != nil {
+				return nil, fmt.Errorf("Channel %s in %s: %s", itr.Name, filename, err.Error())
+			}
+		}
+	}
+	if config.LogLevel != "" {
+		if _, err := clog.ParseLevel(config.LogLevel); err != nil {
+			return nil, fmt.Errorf("%s: %s", filename, err.Error())
+		}
+	}
+	if config.Timeouts.Default < 0 || config.Timeouts.Extended < 0 || config.Timeouts.Shutdown < 0 {
+		return nil, fmt.Errorf("Timeouts cannot be negative in %s", filename)
+	}
+	return &config, nil
+}
+
+// applyConfig copies the settings of a configuration file to the options that
+// were not given on the command line.
+func applyConfig(config *Config) {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	if !set["listen"] && config.Listen != "" {
+		optListen = config.Listen
+	}
+	if !set["data-dir"] && config.DataDir != "" {
+		optDataDir = config.DataDir
+	}
+	if !set["static-dir"] && config.StaticDir != "" {
+		optStaticDir = config.StaticDir
+	}
+	if !set["view-dir"] && config.ViewDir != "" {
+		optViewDir = config.ViewDir
+	}
+	if !set["credentials"] && config.Credentials != "" {
+		optCredentials = config.Credentials
+	}
+	if !set["log-level"] && config.LogLevel != "" {
+		optLogLevel = config.LogLevel
+	}
+	if !set["timeout"] && config.Timeouts.Default != 0 {
+		optTimeout = config.Timeouts.Default
+	}
+	if !set["extended-timeout"] && config.Timeouts.Extended != 0 {
+		optExtendedTimeout = config.Timeouts.Extended
+	}
+	if !set["shutdown-timeout"] && config.Timeouts.Shutdown != 0 {
+		optShutdownTimeout = config.Timeouts.Shutdown
+	}
+	if !set["power-off-on-exit"] && config.PowerOffOnExit {
+		optPowerOffOnExit = true
+	}
+
+	optInterfaceOptions = make(map[string]models.InterfaceOptions)
+	for _, itr := range config.Interfaces {
+		optInterfaceOptions[itr.Device] = models.InterfaceOptions{PowerOn: itr.PowerOn, Termination: itr.Termination}
+	}
+	if !set["interface"] {
+		optDeviceStrings = nil
+		for _, itr := range config.Interfaces {
+			optDeviceStrings = append(optDeviceStrings, itr.Device)
+		}
+	}
+	if !set["channel"] {
+		optChannels = nil
+		for _, itr := range config.Channels {
+			if itr.Type != "" {
+				optChannels = append(optChannels, itr.Name+"="+itr.Type)
+			} else {
+				optChannels = append(optChannels, itr.Name)
+			}
+		}
+	}
+}
+
+// dataPath returns the path of a file or directory of the manager, relative
+// to the data directory unless it is absolute.
+func dataPath(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(optDataDir, path)
+}
+
+func configureLogging() error {
+	level, err := clog.ParseLevel(optLogLevel)
+	if err != nil {
+		return err
+	}
+	clog.SetLevel(level)
+	return nil
+}
+
+func configureTimeouts() error {
+	if optTimeout <= 0 || optExtendedTimeout <= 0 {
+		return fmt.Errorf("Timeouts must be positive")
+	}
+	models.SetTimeouts(optTimeout, optExtendedTimeout)
+	return nil
+}
+
+// declaredTypes holds the channel types of the configuration when it was
+// last loaded.
+var declaredTypes = make(map[string]models.ChannelType)
+
+// declareChannels registers the channels given in the configuration or on the
+// command line and sets their types. On reload, a type is only set again if it
+// changed in the configuration or if the channel was removed, so that types
+// changed while running are kept. Types that are overridden are logged.
+func declareChannels() error {
+	for _, itr := range optChannels {
+		i := strings.LastIndex(itr, "=")
+		if i < 0 {
+			if _, err := models.Channels.Register(itr); err != nil {
+				return err
+			}
+			continue
+		}
+
+		name := itr[:i]
+		channelType, err := models.ParseChannelType(itr[i+1:])
+		if err != nil {
+			return fmt.Errorf("Incorrect channel '%s': %s", itr, err.Error())
+		}
+		channel, exists := models.Channels.Lookup(name)
+		if previous, ok := declaredTypes[name]; exists && ok && previous == channelType {
+			continue
+		}
+		if exists {
+			if current, _ := models.Channels.GetType(channel); current != channelType {
+				clog.Warning("Type of channel %s is changed from '%s' to '%s' by the configuration", name, current, channelType)
+			}
+		}
+		if _, err = models.Channels.Declare(name, channelType); err != nil {
+			return err
+		}
+		declaredTypes[name] = channelType
+	}
+	return nil
+}
+
+// reloadConfig reads the configuration file again and applies the settings
+// that can be changed while running: log level, timeouts, channels, interface
+// options and the users of the credentials file. Other changes are reported
+// and require a restart.
+func reloadConfig() {
+	config, err := LoadConfig(optConfig)
+	if err != nil {
+		clog.Error("Failed to reload configuration: %s", err.Error())
+		return
+	}
+
+	listen, dataDir, staticDir, viewDir := optListen, optDataDir, optStaticDir, optViewDir
+	devices := optDeviceStrings
+	options := optInterfaceOptions
+	shutdownTimeout, powerOff := optShutdownTimeout, optPowerOffOnExit
+	credentials := optCredentials
+	applyConfig(config)
+	if optListen != listen || optDataDir != dataDir || optStaticDir != staticDir || optViewDir != viewDir || !reflect.DeepEqual(optDeviceStrings, devices) {
+		clog.Warning("Changes to the listen address, directories or interfaces in %s will only apply after a restart", optConfig)
+	}
+	if optShutdownTimeout != shutdownTimeout || optPowerOffOnExit != powerOff || optCredentials != credentials {
+		clog.Warning("Changes to the shutdown settings or credentials file in %s will only apply after a restart", optConfig)
+	}
+	optListen, optDataDir, optStaticDir, optViewDir = listen, dataDir, staticDir, viewDir
+	optDeviceStrings = devices
+	optShutdownTimeout, optPowerOffOnExit = shutdownTimeout, powerOff
+	optCredentials = credentials
+
+	if err := configureLogging(); err != nil {
+		clog.Error(err.Error())
+	}
+	if err := configureTimeouts(); err != nil {
+		clog.Error(err.Error())
+	}
+	if err := declareChannels(); err != nil {
+		clog.Error(err.Error())
+	}
+	if optCredentials != "" {
+		// users are read again, so that secrets can be changed without a restart
+		if err := models.Users.LoadFromFile(optCredentials); err != nil {
+			clog.Error("Failed to reload credentials, keeping the previous ones: %s", err.Error())
+		}
+	}
+	for device, opts := range optInterfaceOptions {
+		driver := models.Interfaces.ByDeviceName(device)
+		if driver == nil || reflect.DeepEqual(options[device], opts) {
+			continue
+		}
+		if err := driver.SetOptions(opts); err != nil {
+			clog.Warning(err.Error())
+		}
+	}
+	clog.Info("Reloaded configuration from %s", optConfig)
+}
+
+func handleReload() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		reloadConfig()
+	}
+}
@@ -1,15 +1,24 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"fmt"
+	"io"
 	//"io/ioutil"
 	"flag"
 	"net/http"
+	"os"
+	"os/signal"
 	"pannetrat.com/nocan"
 	"pannetrat.com/nocan/clog"
 	"pannetrat.com/nocan/controllers"
 	"pannetrat.com/nocan/models"
+	_ "pannetrat.com/nocan/simulator"
+	"pannetrat.com/nocan/view"
 	"strings"
+	"syscall"
+	"time"
 )
 
 type multiString []string
@@ -26,38 +35,245 @@ func (d *multiString) Set(value string) error {
 }
 
 var (
-	optDeviceStrings multiString
-	optChannels      multiString
-	optLogTask       bool
+	optConfig           string
+	optListen           string
+	optDataDir          string
+	optStaticDir        string
+	optViewDir          string
+	optLogLevel         string
+	optTimeout          time.Duration
+	optExtendedTimeout  time.Duration
+	optInterfaceOptions map[string]models.InterfaceOptions
+	optShutdownTimeout  time.Duration
+	optPowerOffOnExit   bool
+	optCredentials      string
+	optHashSecret       bool
+	optNewToken         string
+	optDeviceStrings    multiString
+	optChannels         multiString
+	optLogTask          bool
+	optServe            string
+	optHistoryDir       string
+	optHistoryMax       int
+	optHistoryMaxAge    time.Duration
+	optMqttBroker       string
+	optMqttPrefix       string
+	optMqttQos          uint
+	optMqttRetain       bool
+	optMqttChannels     multiString
+	optPingInterval     time.Duration
+	optSuspectAfter     time.Duration
+	optOfflineAfter     time.Duration
+	optAllocation       string
+	optReserve          multiString
+	optPin              multiString
+	optFirmwareDir      string
+	optFirmwareJobs     int
+	optJobRetention     time.Duration
 )
 
 func init() {
-	flag.Var(&optDeviceStrings, "interface", "Interface to connect to (may be repeated)")
+	flag.StringVar(&optConfig, "config", "", "Read settings from a YAML configuration file, reloaded on SIGHUP (command line options take precedence)")
+	flag.StringVar(&optListen, "listen", ":8888", "Address where the HTTP server listens")
+	flag.StringVar(&optDataDir, "data-dir", ".", "Directory holding nodes.dat, channels.dat and the relative history and firmware directories")
+	flag.StringVar(&optStaticDir, "static-dir", "../static", "Directory of the static files served under /static")
+	flag.StringVar(&optViewDir, "view-dir", view.ViewDir, "Directory of the page templates")
+	flag.StringVar(&optLogLevel, "log-level", "debug", "Minimum level of logged messages: debug, info, warning or error")
+	flag.DurationVar(&optTimeout, "timeout", models.DEFAULT_TIMEOUT, "How long to wait for a response from a node")
+	flag.DurationVar(&optExtendedTimeout, "extended-timeout", models.EXTENDED_TIMEOUT, "How long to wait for slow node operations, such as a reboot")
+	flag.DurationVar(&optShutdownTimeout, "shutdown-timeout", 30*time.Second, "How long running jobs may take to finish when the manager is stopped, before being cancelled")
+	flag.BoolVar(&optPowerOffOnExit, "power-off-on-exit", false, "Turn off the power of the bus when the manager is stopped")
+	flag.StringVar(&optCredentials, "credentials", "", "File of users allowed to access the API, with one name:role:hash line per user, where role is readonly, operator or admin, and token:id:role:hash lines for API tokens (the API is open to anyone if empty)")
+	flag.BoolVar(&optHashSecret, "hash-secret", false, "Read a secret on the standard input and print its hash for the credentials file")
+	flag.StringVar(&optNewToken, "new-token", "", "Create an API token given as id:role, and print it along with its line for the credentials file")
+	flag.Var(&optDeviceStrings, "interface", "Interface to connect to, as a device path or URI such as serial:///dev/ttyUSB0, socketcan://can0, tcp://host:7070 or sim:nodes.yaml (may be repeated)")
 	flag.BoolVar(&optLogTask, "log-task", false, "Add a logging task (helps debug)")
-	flag.Var(&optChannels, "channel", "Register a channel (may be repeated)")
+	flag.Var(&optChannels, "channel", "Register a channel, optionally with a value type as name=type (may be repeated)")
+	flag.StringVar(&optHistoryDir, "history-dir", "history", "Directory where channel history is recorded (empty to disable)")
+	flag.IntVar(&optHistoryMax, "history-max-records", 10000, "Maximum number of history records kept per channel (0 for no limit)")
+	flag.DurationVar(&optHistoryMaxAge, "history-max-age", 0, "Maximum age of history records (e.g. 720h, 0 for no limit)")
+	flag.StringVar(&optMqttBroker, "mqtt-broker", "", "Bridge channels to an MQTT broker (e.g. tcp://localhost:1883)")
+	flag.StringVar(&optMqttPrefix, "mqtt-prefix", "nocan", "MQTT topic prefix for bridged channels")
+	flag.UintVar(&optMqttQos, "mqtt-qos", 0, "MQTT QoS level (0, 1 or 2)")
+	flag.BoolVar(&optMqttRetain, "mqtt-retain", false, "Publish channel updates to MQTT as retained messages")
+	flag.Var(&optMqttChannels, "mqtt-channel", "Only bridge channels matching this MQTT-style filter (may be repeated)")
+	flag.DurationVar(&optPingInterval, "ping-interval", models.Nodes.PingInterval, "Ping nodes that have been quiet for this long (0 disables liveness monitoring)")
+	flag.DurationVar(&optSuspectAfter, "suspect-after", models.Nodes.SuspectAfter, "Mark nodes as suspect after this long without traffic")
+	flag.DurationVar(&optOfflineAfter, "offline-after", models.Nodes.OfflineAfter, "Mark nodes as offline after this long without traffic")
+	flag.StringVar(&optAllocation, "allocation", "open", "Node address allocation mode: open, allowlist (only known or pinned nodes) or approval (new nodes wait in /api/nodes/pending)")
+	flag.Var(&optReserve, "reserve", "Node id or range of ids (e.g. 100-127) that are never allocated automatically (may be repeated)")
+	flag.Var(&optPin, "pin", "Give a fixed id to a node seen for the first time, as udid=id (may be repeated)")
+	flag.StringVar(&optFirmwareDir, "firmware-dir", "firmware", "Directory where the firmware repository is stored (empty to disable)")
+	flag.IntVar(&optFirmwareJobs, "firmware-jobs-per-interface", models.Nodes.FirmwareJobsPerInterface, "Maximum number of firmware operations running at the same time on each interface")
+	flag.DurationVar(&optJobRetention, "job-retention", models.Jobs.Retention, "How long the results of finished jobs are kept (0 to keep them until deleted)")
+	flag.StringVar(&optServe, "serve", "", "Export the interface over TCP on the given address (e.g. :7070) instead of running the manager")
+}
+
+func serveInterface() {
+	if len(optDeviceStrings) != 1 {
+		clog.Fatal("Exactly one --interface must be specified with --serve")
+	}
+	transport, err := models.OpenTransport(optDeviceStrings[0])
+	if err != nil {
+		clog.Fatal("Could not open %s: %s", optDeviceStrings[0], err.Error())
+	}
+	defer transport.Close()
+	if err = models.ServeTransport(optServe, transport); err != nil {
+		clog.Fatal("Interface server failed: %s", err.Error())
+	}
+}
+
+func configureAllocation() error {
+	var err error
+
+	policy := &models.Nodes.Policy
+	if policy.Mode, err = models.ParseAllocationMode(optAllocation); err != nil {
+		return err
+	}
+	for _, itr := range optReserve {
+		r, err := models.ParseNodeRange(itr)
+		if err != nil {
+			return err
+		}
+		policy.Reserved = append(policy.Reserved, r)
+	}
+	for _, itr := range optPin {
+		udid, node, err := models.ParseNodePin(itr)
+		if err != nil {
+			return err
+		}
+		policy.Pins[udid] = node
+	}
+	return nil
+}
+
+// handleShutdown stops the manager on SIGINT or SIGTERM. A second signal
+// exits immediately.
+func handleShutdown(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	s := <-signals
+	clog.Info("Received %s, stopping", s)
+	cancel()
+	s = <-signals
+	clog.Fatal("Received %s again, exiting immediately", s)
+}
+
+func hashSecret() {
+	secret, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		clog.Fatal("Could not read secret: %s", err.Error())
+	}
+	secret = strings.TrimRight(secret, "\r\n")
+	if secret == "" {
+		clog.Fatal("The secret cannot be empty")
+	}
+	hash, err := models.HashSecret(secret)
+	if err != nil {
+		clog.Fatal("Could not hash secret: %s", err.Error())
+	}
+	fmt.Println(hash)
+}
+
+func newToken() {
+	i := strings.LastIndex(optNewToken, ":")
+	if i < 0 {
+		clog.Fatal("Incorrect token '%s', expected id:role", optNewToken)
+	}
+	role, err := models.ParseRole(optNewToken[i+1:])
+	if err != nil {
+		clog.Fatal(err.Error())
+	}
+	token, line, err := models.NewToken(optNewToken[:i], role)
+	if err != nil {
+		clog.Fatal("Could not create token: %s", err.Error())
+	}
+	fmt.Printf("Token: %s\nCredentials line: %s\n", token, line)
 }
 
 func main() {
 	flag.Parse()
 
+	if optHashSecret {
+		hashSecret()
+		return
+	}
+	if optNewToken != "" {
+		newToken()
+		return
+	}
+
+	if optConfig != "" {
+		config, err := LoadConfig(optConfig)
+		if err != nil {
+			clog.Fatal("Could not load configuration: %s", err.Error())
+		}
+		applyConfig(config)
+	}
+	if err := configureLogging(); err != nil {
+		clog.Fatal(err.Error())
+	}
+	if err := configureTimeouts(); err != nil {
+		clog.Fatal(err.Error())
+	}
+	view.ViewDir = optViewDir
+
 	clog.Debug("Start")
-	models.Nodes.LoadFromFile("nodes.dat")
+
+	if optServe != "" {
+		serveInterface()
+		return
+	}
+
+	models.Nodes.LoadFromFile(dataPath("nodes.dat"))
+	models.Nodes.PingInterval = optPingInterval
+	models.Nodes.SuspectAfter = optSuspectAfter
+	models.Nodes.OfflineAfter = optOfflineAfter
+	models.Nodes.FirmwareJobsPerInterface = optFirmwareJobs
+	models.Jobs.Retention = optJobRetention
+	if err := configureAllocation(); err != nil {
+		clog.Fatal(err.Error())
+	}
+	models.Channels.LoadFromFile(dataPath("channels.dat"))
+	if optHistoryDir != "" {
+		if err := models.History.Open(dataPath(optHistoryDir), optHistoryMax, optHistoryMaxAge); err != nil {
+			clog.Fatal("Could not open history directory %s: %s", optHistoryDir, err.Error())
+		}
+	}
+	if optFirmwareDir != "" {
+		if err := models.Firmware.Open(dataPath(optFirmwareDir)); err != nil {
+			clog.Fatal("Could not open firmware directory %s: %s", optFirmwareDir, err.Error())
+		}
+	}
+
+	if optCredentials != "" {
+		if err := models.Users.LoadFromFile(optCredentials); err != nil {
+			clog.Fatal("Could not load credentials: %s", err.Error())
+		}
+	} else {
+		clog.Warning("No credentials file was given, the API is open to anyone who can reach it")
+	}
 
 	main := controllers.NewApplication()
+	main.ListenAddress = optListen
+	main.ShutdownTimeout = optShutdownTimeout
+	main.PowerOffOnExit = optPowerOffOnExit
 
 	if len(optDeviceStrings) > 0 {
 		for _, itr := range optDeviceStrings {
-			_, err := models.Interfaces.AddInterface(itr)
+			id, err := models.Interfaces.AddInterface(itr)
 			if err != nil {
 				return
 			}
+			models.Interfaces.GetInterface(id).Options = optInterfaceOptions[itr]
 		}
 	} else {
 		clog.Warning("No interface was specified! Not much to do here.")
 	}
 
-	for _, itr := range optChannels {
-		models.Channels.Register(itr)
+	if err := declareChannels(); err != nil {
+		clog.Error(err.Error())
+		return
 	}
 
 	if optLogTask {
@@ -67,6 +283,21 @@ func main() {
 		}
 	}
 
+	if optMqttBroker != "" {
+		mt, err := nocan.NewMqttTask(main, nocan.MqttOptions{
+			Broker:   optMqttBroker,
+			ClientId: "nocan-manager",
+			Prefix:   optMqttPrefix,
+			Qos:      byte(optMqttQos),
+			Retain:   optMqttRetain,
+			Channels: optMqttChannels,
+		})
+		if err != nil {
+			clog.Fatal(err.Error())
+		}
+		main.AddTask(mt.Run)
+	}
+
 	homepage := controllers.NewHomePageController()
 
 	main.Router.GET("/api/channels", main.Channels.Index)
@@ -75,20 +306,43 @@ func main() {
 	main.Router.GET("/api/nodes", main.Nodes.Index)
 	main.Router.GET("/api/nodes/:node", main.Nodes.Show)
 	main.Router.PUT("/api/nodes/:node", main.Nodes.Update)
+	main.Router.DELETE("/api/nodes/:node", main.Nodes.Destroy)
+	main.Router.PUT("/api/nodes/:node/address", main.Nodes.UpdateAddress)
+	main.Router.PUT("/api/nodes/:node/attributes", main.Nodes.UpdateAttributes)
+	main.Router.PATCH("/api/nodes/:node/attributes", main.Nodes.UpdateAttributes)
+	main.Router.PUT("/api/nodes/:node/approval", main.Nodes.UpdateApproval)
+	main.Router.DELETE("/api/nodes/:node/approval", main.Nodes.DestroyApproval)
 	main.Router.GET("/api/nodes/:node/flash", main.Nodes.ShowFirmware)
 	main.Router.POST("/api/nodes/:node/flash", main.Nodes.CreateFirmware)
+	main.Router.POST("/api/nodes/:node/flash/diff", main.Nodes.CreateDiff)
 	main.Router.GET("/api/nodes/:node/eeprom", main.Nodes.ShowFirmware)
 	main.Router.POST("/api/nodes/:node/eeprom", main.Nodes.CreateFirmware)
+	main.Router.POST("/api/nodes/:node/eeprom/diff", main.Nodes.CreateDiff)
+	main.Router.GET("/api/firmware", main.Firmware.Index)
+	main.Router.POST("/api/firmware", main.Firmware.Create)
+	main.Router.GET("/api/firmware/:name/:version", main.Firmware.Show)
+	main.Router.DELETE("/api/firmware/:name/:version", main.Firmware.Destroy)
+	main.Router.POST("/api/firmware/:name/:version/rollout", main.Firmware.Rollout)
 	main.Router.GET("/api/interfaces", main.Interfaces.Index)
 	main.Router.GET("/api/interfaces/:interf", main.Interfaces.Show)
 	main.Router.PUT("/api/interfaces/:interf", main.Interfaces.Update)
+	main.Router.GET("/api/jobs", main.Jobs.Index)
 	main.Router.GET("/api/jobs/:id", main.Jobs.Show)
+	main.Router.DELETE("/api/jobs/:id", main.Jobs.Destroy)
 	main.Router.GET("/api/jobs/:id/result", main.Jobs.Result)
+	main.Router.GET("/api/events", main.Events.Stream)
 	//main.Router.GET("/api/ports", main.Ports.Index)
-	main.Router.ServeFiles("/static/*filepath", http.Dir("../static"))
+	main.Router.ServeFiles("/static/*filepath", http.Dir(optStaticDir))
 	//main.Router.GET("/nodes", nodepage.Index)
 	main.Router.GET("/", homepage.Index)
 
-	main.Run()
+	if optConfig != "" {
+		go handleReload()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go handleShutdown(cancel)
+
+	main.Run(ctx)
 	fmt.Println("Done")
 }
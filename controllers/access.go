@@ -0,0 +1,73 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"pannetrat.com/nocan/models"
+	"pannetrat.com/nocan/view"
+	"strings"
+)
+
+// RequiredRole returns the role needed to perform a request. Viewing needs
+// the readonly role, writing channels and pinging or rebooting nodes needs
+// the operator role, and everything else, such as powering the bus, firmware
+// operations and their results, and node management, needs the admin role.
+func RequiredRole(r *http.Request) models.Role {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	api := len(parts) >= 2 && parts[0] == "api"
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		// reading the memory of a node takes it to its bootloader
+		if api && len(parts) == 4 && parts[1] == "nodes" && (parts[3] == "flash" || parts[3] == "eeprom") {
+			return models.ROLE_ADMIN
+		}
+		// job results hold memory dumps and firmware reports, from
+		// operations that all need the admin role
+		if api && len(parts) == 4 && parts[1] == "jobs" && parts[3] == "result" {
+			return models.ROLE_ADMIN
+		}
+		return models.ROLE_READONLY
+	case http.MethodPut:
+		if api && parts[1] == "channels" {
+			return models.ROLE_OPERATOR
+		}
+		if api && len(parts) == 3 && parts[1] == "nodes" {
+			r.ParseForm()
+			if c := r.Form.Get("c"); c == "ping" || c == "reboot" {
+				return models.ROLE_OPERATOR
+			}
+		}
+	}
+	return models.ROLE_ADMIN
+}
+
+// Authenticate identifies the user making a request, either with basic
+// authentication or with an "Authorization: Bearer id.secret" header holding
+// an API token.
+func Authenticate(r *http.Request) (models.User, bool) {
+	if name, secret, ok := r.BasicAuth(); ok {
+		return models.Users.Authenticate(name, secret)
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return models.User{}, false
+	}
+	return models.Users.AuthenticateToken(strings.TrimSpace(auth[len("Bearer "):]))
+}
+
+// CheckAccess replies with 401 Unauthorized or 403 Forbidden and returns
+// false if the user making a request is unknown or lacks the required role.
+func CheckAccess(w http.ResponseWriter, r *http.Request) bool {
+	user, ok := Authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="nocan"`)
+		view.LogHttpError(w, "Authentication required", http.StatusUnauthorized)
+		return false
+	}
+	if role := RequiredRole(r); user.Role < role {
+		view.LogHttpError(w, fmt.Sprintf("User %s has the %s role, but %s %s requires the %s role", user.Name, user.Role, r.Method, r.URL.Path, role), http.StatusForbidden)
+		return false
+	}
+	return true
+}
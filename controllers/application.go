@@ -1,37 +1,112 @@
 package controllers
 
 import (
+	"context"
 	"github.com/julienschmidt/httprouter"
+	"net"
 	"net/http"
 	"pannetrat.com/nocan/clog"
 	"pannetrat.com/nocan/models"
 	"strings"
+	"sync"
+	"time"
 )
 
+const HTTP_SHUTDOWN_TIMEOUT = 5 * time.Second
+
 type Application struct {
-	Router     *httprouter.Router
-	Channels   *ChannelController
-	Nodes      *NodeController
-	Interfaces *InterfaceController
-	Jobs       *JobController
+	ListenAddress   string
+	ShutdownTimeout time.Duration // how long running jobs may take to finish on shutdown
+	PowerOffOnExit  bool
+	Router          *httprouter.Router
+	Channels        *ChannelController
+	Nodes           *NodeController
+	Interfaces      *InterfaceController
+	Jobs            *JobController
+	Events          *EventController
+	Firmware        *FirmwareController
+	tasks           []func(context.Context)
 }
 
 func NewApplication() *Application {
-	app := &Application{}
+	app := &Application{ListenAddress: ":8888", ShutdownTimeout: 30 * time.Second}
 	app.Router = httprouter.New()
 	app.Channels = NewChannelController()
 	app.Nodes = NewNodeController()
 	app.Interfaces = NewInterfaceController()
 	app.Jobs = NewJobController()
+	app.Events = NewEventController()
+	app.Firmware = NewFirmwareController(app.Nodes)
 	return app
 }
 
-func (app *Application) Run() {
-	go http.ListenAndServe(":8888", &CheckRouter{app.Router})
-	go models.Channels.Run()
-	go models.Interfaces.Run()
-	go models.Jobs.Run()
-	models.Nodes.Run()
+// AddTask adds a task that runs along with the models until the application
+// stops, such as the MQTT bridge. Tasks must return once their context is
+// cancelled.
+func (app *Application) AddTask(run func(context.Context)) {
+	app.tasks = append(app.tasks, run)
+}
+
+// Run serves the API and runs the models and tasks until ctx is cancelled. It
+// then stops the HTTP server and the tasks, lets running jobs finish,
+// optionally powers off the bus, and returns once the models have saved their
+// state and the interfaces are closed.
+func (app *Application) Run(ctx context.Context) {
+	var wg, tasks sync.WaitGroup
+
+	server := &http.Server{
+		Addr:    app.ListenAddress,
+		Handler: &CheckRouter{app.Router},
+		// requests such as event streams end when shutting down
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			clog.Fatal("HTTP server failed: %s", err.Error())
+		}
+	}()
+
+	modelCtx, stopModels := context.WithCancel(context.Background())
+	for _, run := range []func(context.Context){models.Channels.Run, models.History.Run, models.Jobs.Run, models.Nodes.Supervise, models.Nodes.Run} {
+		wg.Add(1)
+		go func(run func(context.Context)) {
+			defer wg.Done()
+			run(modelCtx)
+		}(run)
+	}
+	models.Interfaces.Run(modelCtx)
+
+	taskCtx, stopTasks := context.WithCancel(context.Background())
+	for _, run := range app.tasks {
+		tasks.Add(1)
+		go func(run func(context.Context)) {
+			defer tasks.Done()
+			run(taskCtx)
+		}(run)
+	}
+
+	<-ctx.Done()
+	clog.Info("Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), HTTP_SHUTDOWN_TIMEOUT)
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		clog.Warning("HTTP server did not stop cleanly: %s", err.Error())
+		server.Close()
+	}
+	cancel()
+	// tasks bring requests from outside too
+	stopTasks()
+	tasks.Wait()
+
+	// jobs still need the models to talk to nodes
+	models.Jobs.Drain(app.ShutdownTimeout)
+	if app.PowerOffOnExit {
+		models.Interfaces.PowerOff()
+	}
+
+	stopModels()
+	wg.Wait()
+	models.Interfaces.Close()
 }
 
 /****/
@@ -51,5 +126,8 @@ func (cr *CheckRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			r.Method = http.MethodPut
 		}
 	}
+	if models.Users.Enabled() && !CheckAccess(w, r) {
+		return
+	}
 	cr.handler.ServeHTTP(w, r)
 }
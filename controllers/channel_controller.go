@@ -8,7 +8,9 @@ import (
 	"encoding/hex"
 	"pannetrat.com/nocan/models"
 	"pannetrat.com/nocan/view"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type ChannelController struct {
@@ -44,13 +46,19 @@ func (tc *ChannelController) Show(w http.ResponseWriter, r *http.Request, params
 
 	channel, ok := models.Channels.Lookup(channelName)
 
+	// a separate route would conflict with /api/channels/*channel, and a
+	// channel whose name ends with /history takes precedence
+	if !ok && strings.HasSuffix(channelName, "/history") {
+		tc.ShowHistory(w, r, strings.TrimSuffix(channelName, "/history"))
+		return
+	}
 	if !ok {
 		view.LogHttpError(w, "Channel does not exist", http.StatusNotFound)
 		return
 	}
-	content, _ := models.Channels.GetContent(channel)
+	state, _ := models.Channels.GetState(channel)
 
-	context := view.NewContext(r, string(content))
+	context := view.NewContext(r, NewChannelValue(&state))
 
 	switch {
 	case AcceptJSON(r):
@@ -60,6 +68,38 @@ func (tc *ChannelController) Show(w http.ResponseWriter, r *http.Request, params
 	}
 }
 
+// ChannelValue is the representation of a channel returned by Show, where
+// Value is decoded according to the type of the channel.
+type ChannelValue struct {
+	Name      string             `json:"name"`
+	Id        models.Channel     `json:"id"`
+	Type      models.ChannelType `json:"type"`
+	Value     interface{}        `json:"value"`
+	Error     string             `json:"error,omitempty"`
+	RawHex    string             `json:"raw_hex"`
+	Text      string             `json:"-"`
+	UpdatedAt time.Time          `json:"updated_at"`
+}
+
+func NewChannelValue(state *models.ChannelState) *ChannelValue {
+	content := state.Value[:state.ValueLength]
+	cv := &ChannelValue{
+		Name:      state.Name,
+		Id:        state.ChannelId,
+		Type:      state.Type,
+		RawHex:    hex.EncodeToString(content),
+		UpdatedAt: state.UpdatedAt,
+	}
+	var err error
+	if cv.Value, err = state.Type.Decode(content); err != nil {
+		cv.Error = err.Error()
+	}
+	if cv.Text, err = state.Type.Format(content); err != nil {
+		cv.Text = "#" + cv.RawHex
+	}
+	return cv
+}
+
 func (tc *ChannelController) Update(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	channelName := TrimLeftSlash(params.ByName("channel"))
 
@@ -72,18 +112,40 @@ func (tc *ChannelController) Update(w http.ResponseWriter, r *http.Request, para
 
 	r.ParseForm()
 
-	var dst []byte
-	var err error
-	value := r.Form.Get("value")
-	if len(value) > 1 && value[0] == '#' {
-		if dst, err = hex.DecodeString(value[1:]); err != nil {
-			view.LogHttpError(w, "Error decoding hexadecimal string: "+err.Error(), http.StatusBadRequest)
+	_, hasType := r.Form["type"]
+	_, hasValue := r.Form["value"]
+	if !hasType && !hasValue {
+		view.LogHttpError(w, "Missing 'value' or 'type' parameter", http.StatusBadRequest)
+		return
+	}
+
+	channelType, _ := models.Channels.GetType(channel)
+	if hasType {
+		var err error
+		if channelType, err = models.ParseChannelType(r.Form.Get("type")); err != nil {
+			view.LogHttpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// the value is checked against the new type before anything is changed
+	var content []byte
+	if hasValue {
+		var err error
+		if content, err = channelType.Encode(r.Form.Get("value")); err != nil {
+			view.LogHttpError(w, "Incorrect value for channel "+channelName+": "+err.Error(), http.StatusBadRequest)
 			return
 		}
-	} else {
-		dst = []byte(value)
 	}
-	models.Channels.Publish(channel, dst)
+
+	if hasType {
+		models.Channels.SetType(channel, channelType)
+	}
+
+	if hasValue && !models.Channels.Publish(channel, content) {
+		view.LogHttpError(w, "Failed to publish to channel "+channelName, http.StatusInternalServerError)
+		return
+	}
 
 	if !AcceptJSON(r) {
 		context := view.NewContext(r, nil)
@@ -91,3 +153,67 @@ func (tc *ChannelController) Update(w http.ResponseWriter, r *http.Request, para
 		view.RedirectTo(w, r, fmt.Sprintf("/api/channels/%s", channelName), context)
 	}
 }
+
+type HistoryItem struct {
+	Time     time.Time   `json:"time"`
+	Node     models.Node `json:"node"`
+	DataHex  string      `json:"data_hex"`
+	DataText string      `json:"data_text"`
+}
+
+func ParseTimeParameter(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// ShowHistory handles GET /api/channels/*channel/history?from=&to=&limit=,
+// where from and to are RFC3339 dates or UNIX timestamps.
+func (tc *ChannelController) ShowHistory(w http.ResponseWriter, r *http.Request, channelName string) {
+	channel, ok := models.Channels.Lookup(channelName)
+	if !ok {
+		view.LogHttpError(w, "Channel does not exist", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	from, err := ParseTimeParameter(query.Get("from"))
+	if err != nil {
+		view.LogHttpError(w, "Incorrect 'from' parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := ParseTimeParameter(query.Get("to"))
+	if err != nil {
+		view.LogHttpError(w, "Incorrect 'to' parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := 0
+	if query.Get("limit") != "" {
+		if limit, err = strconv.Atoi(query.Get("limit")); err != nil || limit < 0 {
+			view.LogHttpError(w, "Incorrect 'limit' parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	records, err := models.History.Query(channel, from, to, limit)
+	if err != nil {
+		view.LogHttpError(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	res := make([]HistoryItem, 0, len(records))
+	for _, record := range records {
+		res = append(res, HistoryItem{
+			Time:     record.Time,
+			Node:     record.Node,
+			DataHex:  hex.EncodeToString(record.Data),
+			DataText: models.DataToText(record.Data),
+		})
+	}
+
+	view.RenderJSON(w, view.NewContext(r, res))
+}
@@ -0,0 +1,186 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"pannetrat.com/nocan/clog"
+	"pannetrat.com/nocan/models"
+	"pannetrat.com/nocan/view"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	EVENT_QUEUE_SIZE         = 64
+	EVENT_KEEPALIVE_INTERVAL = 30 * time.Second
+)
+
+type EventController struct {
+}
+
+func NewEventController() *EventController {
+	return &EventController{}
+}
+
+// NewEventFilter builds a message filter from the 'node', 'channel' and
+// 'function' query parameters, each of which may be repeated. A message must
+// match at least one value of each parameter that is present.
+func NewEventFilter(r *http.Request) (models.MessageFilter, error) {
+	query := r.URL.Query()
+
+	nodes := make(map[models.Node]bool)
+	for _, s := range query["node"] {
+		node, err := strconv.Atoi(s)
+		if err != nil || node < 0 || node > 127 {
+			return nil, fmt.Errorf("Incorrect node parameter '%s'", s)
+		}
+		nodes[models.Node(node)] = true
+	}
+
+	channels := make(map[string]bool)
+	for _, s := range query["channel"] {
+		channels[TrimLeftSlash(s)] = true
+	}
+
+	functions := make(map[string]bool)
+	for _, s := range query["function"] {
+		s = strings.ToUpper(s)
+		if !strings.HasPrefix(s, "NOCAN_SYS_") {
+			s = "NOCAN_SYS_" + s
+		}
+		functions[s] = true
+	}
+
+	return func(m *models.Message) bool {
+		if len(nodes) > 0 && !nodes[m.Id.GetNode()] {
+			return false
+		}
+		if len(channels) > 0 {
+			if m.Id.IsSystem() {
+				return false
+			}
+			name, ok := models.Channels.GetName(m.Id.GetChannel())
+			if !ok || !channels[name] {
+				return false
+			}
+		}
+		if len(functions) > 0 {
+			if !m.Id.IsSystem() || !functions[models.NocanSysFuncString(m.Id.GetSysFunc())] {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// NewNodeStatusFilter selects node status events according to the 'node'
+// query parameter. Status events are not sent to clients that only asked for
+// specific channels or functions.
+func NewNodeStatusFilter(r *http.Request) func(*models.NodeStatusEvent) bool {
+	query := r.URL.Query()
+
+	if len(query["channel"]) > 0 || len(query["function"]) > 0 {
+		return func(*models.NodeStatusEvent) bool { return false }
+	}
+	nodes := make(map[models.Node]bool)
+	for _, s := range query["node"] {
+		// already validated by NewEventFilter
+		node, _ := strconv.Atoi(s)
+		nodes[models.Node(node)] = true
+	}
+	return func(event *models.NodeStatusEvent) bool {
+		return len(nodes) == 0 || nodes[event.Node]
+	}
+}
+
+// Stream sends decoded bus messages, as well as node status changes, to the
+// client as Server-Sent Events, until the client disconnects.
+func (ec *EventController) Stream(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		view.LogHttpError(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	filter, err := NewEventFilter(r)
+	if err != nil {
+		view.LogHttpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	statusFilter := NewNodeStatusFilter(r)
+
+	port := models.PortManager.CreateFilteredPort("events-"+r.RemoteAddr, filter)
+
+	// Never let a slow client hold back the bus: messages that don't fit in
+	// the queue are dropped.
+	queue := make(chan *models.Message, EVENT_QUEUE_SIZE)
+	go func() {
+		dropped := 0
+		for m := range port.Input {
+			select {
+			case queue <- m:
+			default:
+				dropped++
+				if dropped%EVENT_QUEUE_SIZE == 1 {
+					clog.Warning("Event client %s is too slow, %d messages dropped so far", r.RemoteAddr, dropped)
+				}
+			}
+		}
+		close(queue)
+	}()
+	defer models.PortManager.DestroyPort(port)
+
+	events := models.Events.Subscribe(EVENT_QUEUE_SIZE)
+	defer models.Events.Unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(EVENT_KEEPALIVE_INTERVAL)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case m, ok := <-queue:
+			if !ok {
+				return
+			}
+			js, err := json.Marshal(models.NewMessageEvent(m))
+			if err != nil {
+				clog.Error("Failed to encode event: %s", err.Error())
+				continue
+			}
+			if _, err = fmt.Fprintf(w, "event: message\ndata: %s\n\n", js); err != nil {
+				return
+			}
+			flusher.Flush()
+		case event := <-events:
+			if status, ok := event.Data.(*models.NodeStatusEvent); !ok || !statusFilter(status) {
+				continue
+			}
+			js, err := json.Marshal(event.Data)
+			if err != nil {
+				clog.Error("Failed to encode event: %s", err.Error())
+				continue
+			}
+			if _, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, js); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepalive.C:
+			if _, err := fmt.Fprintf(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			clog.Debug("Event client %s disconnected", r.RemoteAddr)
+			return
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"pannetrat.com/nocan/models"
+	"pannetrat.com/nocan/view"
+	"strings"
+)
+
+type FirmwareController struct {
+	Nodes *NodeController
+}
+
+func NewFirmwareController(nodes *NodeController) *FirmwareController {
+	return &FirmwareController{Nodes: nodes}
+}
+
+func (fc *FirmwareController) Index(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	view.RenderJSON(w, view.NewContext(r, models.Firmware.List()))
+}
+
+// Create stores a firmware image, sent as a multipart form with the
+// 'firmware' file and the 'name' and 'version' fields.
+func (fc *FirmwareController) Create(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	r.ParseMultipartForm(1 << 20)
+	file, _, err := r.FormFile("firmware")
+	if err != nil {
+		view.LogHttpError(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		view.LogHttpError(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	image, err := models.Firmware.Add(r.FormValue("name"), r.FormValue("version"), data)
+	if err != nil {
+		view.LogHttpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/firmware/%s/%s", image.Name, image.Version))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	view.RenderJSON(w, view.NewContext(r, image))
+}
+
+func (fc *FirmwareController) GetImage(w http.ResponseWriter, params httprouter.Params) (*models.FirmwareImage, bool) {
+	image, ok := models.Firmware.Find(params.ByName("name"), params.ByName("version"))
+	if !ok {
+		view.LogHttpError(w, "Firmware does not exist", http.StatusNotFound)
+		return nil, false
+	}
+	return image, true
+}
+
+// Show returns the Intel HEX file of an image.
+func (fc *FirmwareController) Show(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	image, ok := fc.GetImage(w, params)
+	if !ok {
+		return
+	}
+
+	data, err := models.Firmware.ReadFile(image)
+	if err != nil {
+		view.LogHttpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s-%s.hex\"", image.Name, image.Version))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func (fc *FirmwareController) Destroy(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if !models.Firmware.Remove(params.ByName("name"), params.ByName("version")) {
+		view.LogHttpError(w, "Firmware does not exist", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Rollout starts a job flashing an image on the nodes given by the 'node'
+// parameter, which may be repeated, or on all nodes with the attribute given
+// by the 'attribute' parameter, as key=value. Nodes are flashed one at a time,
+// and the job stops on the first failure. All nodes are reserved for the whole
+// rollout, which is refused with 409 Conflict if one of them is busy. With
+// 'delta' set, only the pages that differ are written.
+func (fc *FirmwareController) Rollout(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var nodes []models.Node
+
+	image, ok := fc.GetImage(w, params)
+	if !ok {
+		return
+	}
+
+	r.ParseForm()
+
+	for _, s := range r.Form["node"] {
+		node, ok := fc.Nodes.GetNode(s)
+		if !ok || models.Nodes.GetProperties(node) == nil {
+			view.LogHttpError(w, "Node "+s+" does not exist", http.StatusNotFound)
+			return
+		}
+		nodes = append(nodes, node)
+	}
+	if attribute := r.Form.Get("attribute"); attribute != "" {
+		kv := strings.SplitN(attribute, "=", 2)
+		if len(kv) != 2 {
+			view.LogHttpError(w, "The 'attribute' parameter must be of the form key=value", http.StatusBadRequest)
+			return
+		}
+	selected:
+		for _, node := range models.Nodes.Select(kv[0], kv[1]) {
+			for _, n := range nodes {
+				if n == node {
+					continue selected
+				}
+			}
+			nodes = append(nodes, node)
+		}
+	}
+	if len(nodes) == 0 {
+		view.LogHttpError(w, "No node was selected for the rollout", http.StatusBadRequest)
+		return
+	}
+
+	ihex, err := models.Firmware.Load(image)
+	if err != nil {
+		view.LogHttpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ValidateImage(w, nodes, 'F', ihex) {
+		return
+	}
+
+	delta := FlagParam(r.Form.Get("delta"))
+	jobid, err := models.Jobs.CreateNodeJob("rollout of "+image.Id(), nodes, func(state *models.JobState) {
+		models.Firmware.Rollout(state, image, nodes, delta)
+	})
+	if err != nil {
+		LogNodeError(w, err, http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/jobs/%d", jobid))
+	w.WriteHeader(http.StatusAccepted)
+}
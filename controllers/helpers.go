@@ -1,7 +1,12 @@
 package controllers
 
 import (
+	"encoding/json"
 	"net/http"
+	"pannetrat.com/nocan/clog"
+	"pannetrat.com/nocan/intelhex"
+	"pannetrat.com/nocan/models"
+	"pannetrat.com/nocan/view"
 )
 
 /** ACCEPT **/
@@ -13,3 +18,51 @@ func AcceptJSON(r *http.Request) bool {
 func AcceptHTML(r *http.Request) bool {
 	return r.Header.Get("Accept") == "text/html"
 }
+
+/** PARAMETERS **/
+
+// FlagParam tells whether a boolean parameter such as '?delta=1' is set.
+func FlagParam(value string) bool {
+	return value != "" && value != "0" && value != "false"
+}
+
+/** ERRORS **/
+
+// LogNodeError reports an error with 409 Conflict if it is a NodeBusyError,
+// or with the given status code otherwise.
+func LogNodeError(w http.ResponseWriter, err error, code int) {
+	if _, busy := err.(*models.NodeBusyError); busy {
+		code = http.StatusConflict
+	}
+	view.LogHttpError(w, err.Error(), code)
+}
+
+type ValidationResult struct {
+	Error   string                         `json:"error"`
+	Invalid []*models.ImageValidationError `json:"invalid"`
+}
+
+// ValidateImage checks that an image can be written to each node. Otherwise,
+// it answers 422 Unprocessable Entity with a JSON body listing the offending
+// ranges for each node, and returns false.
+func ValidateImage(w http.ResponseWriter, nodes []models.Node, fwtype byte, ihex *intelhex.IntelHex) bool {
+	result := ValidationResult{Error: "Firmware does not fit the memory of the target nodes"}
+	for _, node := range nodes {
+		if err := models.Nodes.ValidateImage(node, fwtype, ihex); err != nil {
+			clog.Warning("%s", err.Error())
+			result.Invalid = append(result.Invalid, err.(*models.ImageValidationError))
+		}
+	}
+	if len(result.Invalid) == 0 {
+		return true
+	}
+	if len(result.Invalid) == 1 {
+		result.Error = result.Invalid[0].Error()
+	}
+
+	js, _ := json.MarshalIndent(result, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	w.Write(js)
+	return false
+}
@@ -79,6 +79,10 @@ func (dc *InterfaceController) Update(w http.ResponseWriter, r *http.Request, pa
 		return
 	}
 
+	if err == models.InterfaceUnsupportedError {
+		view.LogHttpError(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
 	if err != nil {
 		view.LogHttpError(w, err.Error(), http.StatusServiceUnavailable)
 	}
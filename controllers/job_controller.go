@@ -17,6 +17,11 @@ func NewJobController() *JobController {
 	return controller
 }
 
+// Index lists the jobs that are running or whose results are still kept.
+func (jc *JobController) Index(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	view.RenderJSON(w, view.NewContext(r, models.Jobs.List()))
+}
+
 func (jc *JobController) GetJobId(w http.ResponseWriter, jobIdString string) *models.JobState {
 	jobId, err := strconv.ParseUint(jobIdString, 10, 32)
 	if err != nil {
@@ -46,18 +51,35 @@ func (jc *JobController) Show(w http.ResponseWriter, r *http.Request, params htt
 		fmt.Fprintf(w, "%d", job.GetProgress())
 
 	case models.JobCompleted:
-		if job.Result != nil {
+		if result, _ := job.GetResult(); result != nil {
 			w.Header().Set("Location", r.RequestURI+"/result")
-		} else {
-			models.Jobs.FinalizeJob(job.Id)
 		}
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintf(w, "done")
 
 	case models.JobFailed:
-		view.LogHttpError(w, fmt.Sprintf("Job %d failed, %s", job.Id, job.FailureReason.Error()), http.StatusServiceUnavailable)
-		models.Jobs.FinalizeJob(job.Id)
+		view.LogHttpError(w, fmt.Sprintf("Job %d failed, %s", job.Id, job.Info().Error), http.StatusServiceUnavailable)
+
+	case models.JobCancelled:
+		view.LogHttpError(w, fmt.Sprintf("Job %d was cancelled, %s", job.Id, job.Info().Error), http.StatusGone)
+	}
+}
+
+// Destroy cancels a running job, which stops at the next safe point, such as
+// between two bootloader pages, and answers 202 Accepted. A finished job is
+// removed along with its result.
+func (jc *JobController) Destroy(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	job := jc.GetJobId(w, params.ByName("id"))
+	if job == nil {
+		return
+	}
+
+	if models.Jobs.CancelJob(job.Id) {
+		w.WriteHeader(http.StatusAccepted)
+		return
 	}
+	models.Jobs.FinalizeJob(job.Id)
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (jc *JobController) Result(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
@@ -66,10 +88,14 @@ func (jc *JobController) Result(w http.ResponseWriter, r *http.Request, params h
 	if job == nil {
 		return
 	}
-	w.Header().Set("Content-Disposition", "attachment; filename=\"firmware.hex\"")
+	result, resultType := job.GetResult()
+	if resultType != "" {
+		w.Header().Set("Content-Type", resultType)
+	} else {
+		w.Header().Set("Content-Disposition", "attachment; filename=\"firmware.hex\"")
+	}
 	w.WriteHeader(http.StatusOK)
-	if job.Result != nil {
-		w.Write(job.Result)
+	if result != nil {
+		w.Write(result)
 	}
-	models.Jobs.FinalizeJob(job.Id)
 }
@@ -1,13 +1,19 @@
 package controllers
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/julienschmidt/httprouter"
+	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
 	"pannetrat.com/nocan/clog"
 	"pannetrat.com/nocan/intelhex"
 	"pannetrat.com/nocan/models"
 	"pannetrat.com/nocan/view"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -20,20 +26,24 @@ func NewNodeController() *NodeController {
 	return controller
 }
 
+// Index lists the ids of the nodes, or their full state with ?details=1 (the
+// HTML view always shows the state).
 func (nc *NodeController) Index(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	var res []models.Node = make([]models.Node, 0)
-
-	models.Nodes.Each(func(n models.Node, _ *models.NodeState) {
-		res = append(res, n)
-	})
+	nodes := models.Nodes.List()
 
-	context := view.NewContext(r, res)
-
-	if AcceptJSON(r) {
-		view.RenderJSON(w, context)
-	} else {
-		view.RenderAceTemplate(w, "base", "node_index", context)
+	if !AcceptJSON(r) {
+		view.RenderAceTemplate(w, "base", "node_index", view.NewContext(r, nodes))
+		return
+	}
+	if details, _ := strconv.ParseBool(r.URL.Query().Get("details")); details {
+		view.RenderJSON(w, view.NewContext(r, nodes))
+		return
+	}
+	var res []models.Node = make([]models.Node, 0)
+	for _, state := range nodes {
+		res = append(res, state.Id)
 	}
+	view.RenderJSON(w, view.NewContext(r, res))
 }
 
 func (nc *NodeController) GetNode(nodeName string) (models.Node, bool) {
@@ -47,7 +57,8 @@ func (nc *NodeController) GetNode(nodeName string) (models.Node, bool) {
 
 	node, err := strconv.Atoi(nodeName)
 
-	if err != nil {
+	// checked before the conversion, which would wrap ids such as 300
+	if err != nil || node < 1 || node > 127 {
 		return models.Node(-1), false
 	}
 
@@ -55,6 +66,12 @@ func (nc *NodeController) GetNode(nodeName string) (models.Node, bool) {
 }
 
 func (nc *NodeController) Show(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	// a separate route would conflict with /api/nodes/:node
+	if params.ByName("node") == "pending" {
+		nc.ShowPending(w, r)
+		return
+	}
+
 	node, ok := nc.GetNode(params.ByName("node"))
 	if !ok {
 		http.Error(w, "Node does not exist", http.StatusNotFound)
@@ -95,18 +112,226 @@ func (nc *NodeController) Update(w http.ResponseWriter, r *http.Request, params
 	switch r.Form.Get("c") {
 	case "reboot":
 		if err := models.Nodes.DoReboot(node); err != nil {
-			view.LogHttpError(w, err.Error(), http.StatusServiceUnavailable)
+			LogNodeError(w, err, http.StatusServiceUnavailable)
 		}
 	case "ping":
 		if err := models.Nodes.DoPing(node); err != nil {
 			view.LogHttpError(w, err.Error(), http.StatusServiceUnavailable)
 		}
+	case "identify":
+		mcu, err := models.Nodes.DoIdentify(node)
+		if err != nil {
+			LogNodeError(w, err, http.StatusServiceUnavailable)
+			return
+		}
+		view.RenderJSON(w, view.NewContext(r, mcu))
 	default:
 		view.LogHttpError(w, "Unknown command", http.StatusBadRequest)
 	}
 	/* success */
 }
 
+// Destroy handles DELETE /api/nodes/:node, which frees the id of a node. If
+// the node is on the bus, it is rebooted and will request a new address.
+func (nc *NodeController) Destroy(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	node, ok := nc.GetNode(params.ByName("node"))
+	if !ok {
+		view.LogHttpError(w, "Node does not exist", http.StatusNotFound)
+		return
+	}
+
+	if err := models.Nodes.Decommission(node); err != nil {
+		if err == models.NodeNotFoundError {
+			view.LogHttpError(w, err.Error(), http.StatusNotFound)
+		} else {
+			LogNodeError(w, err, http.StatusBadRequest)
+		}
+		return
+	}
+
+	if AcceptJSON(r) {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		context := view.NewContext(r, nil)
+		context.AddFlashItem("notice", fmt.Sprintf("Node %d was decommissioned", node))
+		view.RedirectTo(w, r, "/api/nodes", context)
+	}
+}
+
+// UpdateAddress handles PUT /api/nodes/:node/address with an 'id' parameter,
+// which moves the UDID of the node to a new node id.
+func (nc *NodeController) UpdateAddress(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	node, ok := nc.GetNode(params.ByName("node"))
+	if !ok {
+		view.LogHttpError(w, "Node does not exist", http.StatusNotFound)
+		return
+	}
+
+	r.ParseForm()
+
+	newNode, err := strconv.Atoi(r.Form.Get("id"))
+	if err != nil || newNode < 1 || newNode > 127 {
+		view.LogHttpError(w, "The 'id' parameter must be a node number between 1 and 127", http.StatusBadRequest)
+		return
+	}
+
+	if err := models.Nodes.Reassign(node, models.Node(newNode)); err != nil {
+		if err == models.NodeNotFoundError {
+			view.LogHttpError(w, err.Error(), http.StatusNotFound)
+		} else {
+			view.LogHttpError(w, err.Error(), http.StatusConflict)
+		}
+		return
+	}
+
+	if AcceptJSON(r) {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		context := view.NewContext(r, nil)
+		context.AddFlashItem("notice", fmt.Sprintf("Node %d was reassigned to node %d", node, newNode))
+		view.RedirectTo(w, r, "/api/nodes", context)
+	}
+}
+
+type AttributesResult struct {
+	Attributes models.NodeAttributes `json:"attributes"`
+	Renamed    map[string]string     `json:"renamed_channels,omitempty"`
+}
+
+// UpdateAttributes handles PUT and PATCH /api/nodes/:node/attributes. A JSON
+// object replaces the attributes (PUT) or is merged into them (PATCH), where
+// null values remove attributes. HTML forms set a single attribute with the
+// 'key' and 'value' fields, an empty value removing it. If the 'expand'
+// parameter is set, the channels registered by the node are renamed
+// according to the new attributes.
+func (nc *NodeController) UpdateAttributes(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	node, ok := nc.GetNode(params.ByName("node"))
+	if !ok {
+		view.LogHttpError(w, "Node does not exist", http.StatusNotFound)
+		return
+	}
+
+	var attributes models.NodeAttributes
+	merge := r.Method == http.MethodPatch
+
+	// the media type may come with parameters such as charset=UTF-8
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/x-www-form-urlencoded" {
+		r.ParseForm()
+		key := r.Form.Get("key")
+		if key == "" {
+			view.LogHttpError(w, "Missing 'key' parameter", http.StatusBadRequest)
+			return
+		}
+		attributes = models.NodeAttributes{key: nil}
+		if value := r.Form.Get("value"); value != "" {
+			attributes[key] = value
+		}
+		merge = true
+	} else {
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&attributes); err != nil {
+			view.LogHttpError(w, "Attributes must be a JSON object: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := models.Nodes.UpdateAttributes(node, attributes, merge)
+	if err != nil {
+		if err == models.NodeNotFoundError {
+			view.LogHttpError(w, err.Error(), http.StatusNotFound)
+		} else {
+			view.LogHttpError(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+
+	res := AttributesResult{Attributes: result}
+	if FlagParam(r.URL.Query().Get("expand")) {
+		res.Renamed = models.Channels.ExpandNodeChannels(node)
+	}
+
+	if AcceptJSON(r) {
+		view.RenderJSON(w, view.NewContext(r, res))
+	} else {
+		context := view.NewContext(r, nil)
+		context.AddFlashItem("notice", "Successfully updated node attributes")
+		view.RedirectTo(w, r, fmt.Sprintf("/api/nodes/%d", node), context)
+	}
+}
+
+// ShowPending lists the nodes waiting for approval, in the 'approval'
+// allocation mode.
+func (nc *NodeController) ShowPending(w http.ResponseWriter, r *http.Request) {
+	res := make([]models.PendingNode, 0)
+
+	models.Nodes.EachPending(func(pending *models.PendingNode) {
+		res = append(res, *pending)
+	})
+	sort.Slice(res, func(i, j int) bool { return res[i].FirstSeen.Before(res[j].FirstSeen) })
+
+	context := view.NewContext(r, res)
+
+	if AcceptJSON(r) {
+		view.RenderJSON(w, context)
+	} else {
+		view.RenderAceTemplate(w, "base", "node_pending", context)
+	}
+}
+
+// UpdateApproval handles PUT /api/nodes/:udid/approval, which gives an
+// address to a pending node: the one in the optional 'id' parameter, or the
+// next one allowed by the allocation policy.
+func (nc *NodeController) UpdateApproval(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	udid := params.ByName("node")
+
+	r.ParseForm()
+
+	id := -1
+	if r.Form.Get("id") != "" {
+		var err error
+		if id, err = strconv.Atoi(r.Form.Get("id")); err != nil || id < 1 || id > 127 {
+			view.LogHttpError(w, "The 'id' parameter must be a node number between 1 and 127", http.StatusBadRequest)
+			return
+		}
+	}
+
+	node, err := models.Nodes.Approve(udid, models.Node(id))
+	if err != nil {
+		if err == models.NodeNotFoundError {
+			view.LogHttpError(w, "Node "+udid+" is not waiting for approval", http.StatusNotFound)
+		} else {
+			view.LogHttpError(w, err.Error(), http.StatusConflict)
+		}
+		return
+	}
+
+	if AcceptJSON(r) {
+		view.RenderJSON(w, view.NewContext(r, models.Nodes.GetProperties(node)))
+	} else {
+		context := view.NewContext(r, nil)
+		context.AddFlashItem("notice", fmt.Sprintf("Node %s was approved as node %d", udid, node))
+		view.RedirectTo(w, r, "/api/nodes/pending", context)
+	}
+}
+
+// DestroyApproval handles DELETE /api/nodes/:udid/approval, which removes a
+// node from the approval queue.
+func (nc *NodeController) DestroyApproval(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	udid := params.ByName("node")
+
+	if err := models.Nodes.Reject(udid); err != nil {
+		view.LogHttpError(w, "Node "+udid+" is not waiting for approval", http.StatusNotFound)
+		return
+	}
+
+	if AcceptJSON(r) {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		context := view.NewContext(r, nil)
+		context.AddFlashItem("notice", fmt.Sprintf("Node %s was rejected", udid))
+		view.RedirectTo(w, r, "/api/nodes/pending", context)
+	}
+}
+
 func (nc *NodeController) GetFirmwareNodeAndType(w http.ResponseWriter, r *http.Request, params httprouter.Params) (models.Node, byte, bool) {
 	node, ok := nc.GetNode(params.ByName("node"))
 	if !ok {
@@ -119,9 +344,10 @@ func (nc *NodeController) GetFirmwareNodeAndType(w http.ResponseWriter, r *http.
 	}
 
 	var fwtype byte
-	if strings.HasSuffix(r.URL.Path, "/flash") {
+	path := strings.TrimSuffix(r.URL.Path, "/diff")
+	if strings.HasSuffix(path, "/flash") {
 		fwtype = 'F'
-	} else if strings.HasSuffix(r.URL.Path, "/eeprom") {
+	} else if strings.HasSuffix(path, "/eeprom") {
 		fwtype = 'E'
 	} else {
 		// should never get here
@@ -137,63 +363,190 @@ func (nc *NodeController) ShowFirmware(w http.ResponseWriter, r *http.Request, p
 		return
 	}
 
-	var fwsize uint32
+	mcu := models.Nodes.Mcu(node)
+	fwsize := mcu.MemorySize(fwtype)
 	fwsize_string := r.URL.Query().Get("size")
-	if len(fwsize_string) == 0 {
-		if fwtype == 'F' {
-			fwsize = 0x7000
-		} else {
-			fwsize = 0x400
-		}
-	} else {
+	if len(fwsize_string) > 0 {
 		fwsize64, err := strconv.ParseUint(fwsize_string, 10, 32)
 		if err != nil {
 			view.LogHttpError(w, "Incorrect size parameter", http.StatusBadRequest)
 			return
 		}
-		if fwtype == 'F' && fwsize64 > 0x7000 {
-			view.LogHttpError(w, "Flash size cannot exceed 28672 bytes (the following 4K above this limit is used by the bootloader)", http.StatusBadRequest)
+		if fwtype == 'F' && fwsize64 > uint64(fwsize) {
+			view.LogHttpError(w, fmt.Sprintf("Flash size cannot exceed %d bytes on %s (the following %d bytes are used by the bootloader)", fwsize, mcu.Name, mcu.BootloaderSize), http.StatusBadRequest)
+			return
 		}
-		if fwtype == 'E' && fwsize64 > 0x400 {
-			view.LogHttpError(w, "Eeprom size cannot exceed 1024 bytes", http.StatusBadRequest)
+		if fwtype == 'E' && fwsize64 > uint64(fwsize) {
+			view.LogHttpError(w, fmt.Sprintf("Eeprom size cannot exceed %d bytes on %s", fwsize, mcu.Name), http.StatusBadRequest)
 			return
 		}
 		fwsize = uint32(fwsize64)
 	}
 
-	jobid := models.Jobs.CreateJob(func(state *models.JobState) {
+	jobid, err := models.Jobs.CreateNodeJob(fmt.Sprintf("%s download", models.MemoryName(fwtype)), []models.Node{node}, func(state *models.JobState) {
 		models.Nodes.DownloadFirmware(state, node, fwtype, fwsize)
 	})
+	if err != nil {
+		LogNodeError(w, err, http.StatusServiceUnavailable)
+		return
+	}
 
 	w.Header().Set("Location", fmt.Sprintf("/api/jobs/%d", jobid))
 	w.WriteHeader(http.StatusAccepted)
 }
 
-func (nc *NodeController) CreateFirmware(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	node, fwtype, ok := nc.GetFirmwareNodeAndType(w, r, params)
-	if !ok {
-		return
+// ParseFirmware decodes an uploaded image, in the given format or, if format
+// is empty, in the format guessed from its content and file name: Intel HEX
+// ("hex"), raw binary ("bin") loaded at the address given by base, or ELF
+// ("elf"), from which the flash or eeprom sections are extracted.
+func ParseFirmware(data []byte, filename string, format string, base string, fwtype byte) (*intelhex.IntelHex, error) {
+	if format == "" {
+		switch {
+		case intelhex.IsELF(data):
+			format = "elf"
+		case strings.HasSuffix(strings.ToLower(filename), ".bin"):
+			format = "bin"
+		default:
+			format = "hex"
+		}
 	}
 
+	switch format {
+	case "hex", "ihex":
+		ihex := intelhex.New()
+		if err := ihex.Load(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+		return ihex, nil
+	case "bin":
+		var address uint64
+		if base != "" {
+			var err error
+			if address, err = strconv.ParseUint(base, 0, 32); err != nil {
+				return nil, fmt.Errorf("Incorrect base address '%s'", base)
+			}
+		}
+		ihex := intelhex.New()
+		if err := ihex.LoadBinary(bytes.NewReader(data), uint32(address)); err != nil {
+			return nil, err
+		}
+		return ihex, nil
+	case "elf":
+		flash, eeprom, err := intelhex.LoadELF(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		ihex := flash
+		if fwtype == 'E' {
+			ihex = eeprom
+		}
+		if len(ihex.Blocks) == 0 {
+			return nil, fmt.Errorf("ELF file has no %s section", models.MemoryName(fwtype))
+		}
+		return ihex, nil
+	}
+	return nil, fmt.Errorf("Unknown firmware format '%s', expected hex, bin or elf", format)
+}
+
+// GetFirmwareImage returns the image sent with a request, either as a file in
+// the 'firmware' multipart field, or as the id of an image of the firmware
+// repository in the 'image' field (e.g. image=sensor@1.2). Files are decoded
+// with ParseFirmware, using the 'format' and 'base' fields.
+func (nc *NodeController) GetFirmwareImage(w http.ResponseWriter, r *http.Request, fwtype byte) (*intelhex.IntelHex, bool) {
 	r.ParseMultipartForm(1 << 20)
+
+	if id := r.FormValue("image"); id != "" {
+		image, ok := models.Firmware.Lookup(id)
+		if !ok {
+			view.LogHttpError(w, "Firmware "+id+" does not exist", http.StatusNotFound)
+			return nil, false
+		}
+		ihex, err := models.Firmware.Load(image)
+		if err != nil {
+			view.LogHttpError(w, err.Error(), http.StatusInternalServerError)
+			return nil, false
+		}
+		return ihex, true
+	}
+
 	file, header, err := r.FormFile("firmware")
 	if err != nil {
 		view.LogHttpError(w, "Bad request: "+err.Error(), http.StatusBadRequest)
-		return
+		return nil, false
 	}
 	defer file.Close()
 
-	ihex := intelhex.New()
-	if err := ihex.Load(file); err != nil {
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		view.LogHttpError(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	ihex, err := ParseFirmware(data, header.Filename, r.FormValue("format"), r.FormValue("base"), fwtype)
+	if err != nil {
 		view.LogHttpError(w, "Failed to parse firmware: "+err.Error(), http.StatusBadRequest)
-		return
+		return nil, false
 	}
 
 	clog.Debug("Uploaded firmware '%s' is %d bytes", header.Filename, ihex.Size)
+	return ihex, true
+}
+
+func (nc *NodeController) CreateFirmware(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	node, fwtype, ok := nc.GetFirmwareNodeAndType(w, r, params)
+	if !ok {
+		return
+	}
+
+	ihex, ok := nc.GetFirmwareImage(w, r, fwtype)
+	if !ok || !ValidateImage(w, []models.Node{node}, fwtype, ihex) {
+		return
+	}
+
+	delta := FlagParam(r.FormValue("delta"))
+	operation := fmt.Sprintf("%s upload", models.MemoryName(fwtype))
+	if delta {
+		operation = fmt.Sprintf("%s delta upload", models.MemoryName(fwtype))
+	}
+
+	// the id of a repository image, already checked by GetFirmwareImage, is
+	// recorded as the firmware of the node
+	firmware := r.FormValue("image")
+
+	jobid, err := models.Jobs.CreateNodeJob(operation, []models.Node{node}, func(state *models.JobState) {
+		models.Nodes.UploadFirmware(state, node, fwtype, ihex, delta, firmware)
+	})
+	if err != nil {
+		LogNodeError(w, err, http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/jobs/%d", jobid))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// CreateDiff handles POST /api/nodes/:node/flash/diff (or eeprom/diff), which
+// starts a job comparing the memory of a node with an image, sent as for
+// uploads. The job result lists the pages covered by the image and tells which
+// ones differ.
+func (nc *NodeController) CreateDiff(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	node, fwtype, ok := nc.GetFirmwareNodeAndType(w, r, params)
+	if !ok {
+		return
+	}
 
-	jobid := models.Jobs.CreateJob(func(state *models.JobState) {
-		models.Nodes.UploadFirmware(state, node, fwtype, ihex)
+	ihex, ok := nc.GetFirmwareImage(w, r, fwtype)
+	if !ok || !ValidateImage(w, []models.Node{node}, fwtype, ihex) {
+		return
+	}
+
+	jobid, err := models.Jobs.CreateNodeJob(fmt.Sprintf("%s comparison", models.MemoryName(fwtype)), []models.Node{node}, func(state *models.JobState) {
+		models.Nodes.CompareFirmware(state, node, fwtype, ihex)
 	})
+	if err != nil {
+		LogNodeError(w, err, http.StatusServiceUnavailable)
+		return
+	}
 
 	w.Header().Set("Location", fmt.Sprintf("/api/jobs/%d", jobid))
 	w.WriteHeader(http.StatusAccepted)
@@ -0,0 +1,84 @@
+package intelhex
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"pannetrat.com/nocan/clog"
+)
+
+// In AVR ELF files, RAM and eeprom sections are mapped at these offsets.
+const (
+	AVR_DATA_OFFSET   = 0x800000
+	AVR_EEPROM_OFFSET = 0x810000
+	AVR_EEPROM_END    = 0x820000
+)
+
+// LoadBinary adds the content of a raw binary image, starting at address.
+func (ihex *IntelHex) LoadBinary(r io.Reader, address uint32) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return fmt.Errorf("Binary image is empty")
+	}
+	return ihex.Add(0, address, data)
+}
+
+// IsELF tells whether data starts with the ELF magic number.
+func IsELF(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(elf.ELFMAG))
+}
+
+// loadAddress returns the address where a section is loaded, which differs
+// from its address at run time for initialized data that is copied from flash
+// to RAM at startup.
+func loadAddress(f *elf.File, section *elf.Section) uint64 {
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_LOAD && section.Addr >= prog.Vaddr && section.Addr+section.Size <= prog.Vaddr+prog.Memsz {
+			return prog.Paddr + section.Addr - prog.Vaddr
+		}
+	}
+	return section.Addr
+}
+
+// LoadELF extracts the flash and eeprom images of an AVR ELF file, like
+// avr-objcopy does: the flash image holds the loadable sections such as .text
+// and .data at their load address, and the eeprom image holds the .eeprom
+// section. Either image may be empty.
+func LoadELF(r io.ReaderAt) (*IntelHex, *IntelHex, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse ELF file: %s", err.Error())
+	}
+	defer f.Close()
+
+	flash := New()
+	eeprom := New()
+	for _, section := range f.Sections {
+		if section.Type != elf.SHT_PROGBITS || section.Flags&elf.SHF_ALLOC == 0 || section.Size == 0 {
+			continue
+		}
+		data, err := section.Data()
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to read section %s: %s", section.Name, err.Error())
+		}
+
+		address := loadAddress(f, section)
+		switch {
+		case section.Name == ".eeprom" || (address >= AVR_EEPROM_OFFSET && address < AVR_EEPROM_END):
+			err = eeprom.Add(0, uint32(address%AVR_EEPROM_OFFSET), data)
+		case address < AVR_DATA_OFFSET:
+			err = flash.Add(0, uint32(address), data)
+		default:
+			clog.Debug("Ignoring ELF section %s at 0x%x", section.Name, address)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("Section %s: %s", section.Name, err.Error())
+		}
+	}
+	return flash, eeprom, nil
+}
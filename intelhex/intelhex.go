@@ -5,7 +5,10 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"math"
 	"pannetrat.com/nocan/clog"
+	"sort"
+	"strings"
 )
 
 type IntelHexMemBlock struct {
@@ -14,6 +17,11 @@ type IntelHexMemBlock struct {
 	Data    []byte
 }
 
+// End returns the address following the last byte of the block.
+func (block *IntelHexMemBlock) End() uint32 {
+	return block.Address + uint32(len(block.Data))
+}
+
 func (block *IntelHexMemBlock) Copy(dest []byte, offset uint32, maxlen uint32) uint32 {
 	if offset > uint32(len(block.Data)) {
 		return 0
@@ -38,20 +46,57 @@ func New() *IntelHex {
 	return &IntelHex{Size: 0, Blocks: make([]*IntelHexMemBlock, 0, 8)}
 }
 
-func (ihex *IntelHex) Add(btype uint8, address uint32, data []byte) {
+// Add stores data at an address. Data that directly follows or precedes an
+// existing block of the same type is merged with it, and blocks are kept in
+// address order. Data overlapping an existing block is refused.
+func (ihex *IntelHex) Add(btype uint8, address uint32, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	// End() must not wrap around
+	if uint64(address)+uint64(len(data)) > math.MaxUint32 {
+		return fmt.Errorf("Data at 0x%x (%d bytes) extends beyond the 32-bit address space", address, len(data))
+	}
+	end := address + uint32(len(data))
 
 	//clog.Debug("ADD %d @%x len=%d",btype,address,len(data))
-	for i, block := range ihex.Blocks {
-		if btype == block.Type && address == block.Address+uint32(len(block.Data)) {
-			ihex.Blocks[i].Data = append(block.Data, data...)
-			ihex.Size += uint(len(data))
-			return
+	// index of the first block starting after address
+	i := sort.Search(len(ihex.Blocks), func(i int) bool { return ihex.Blocks[i].Address > address })
+
+	var prev, next *IntelHexMemBlock
+	if i > 0 {
+		prev = ihex.Blocks[i-1]
+		if prev.End() > address {
+			return fmt.Errorf("Data at 0x%x overlaps the block at 0x%x-0x%x", address, prev.Address, prev.End()-1)
+		}
+	}
+	if i < len(ihex.Blocks) {
+		next = ihex.Blocks[i]
+		if next.Address < end {
+			return fmt.Errorf("Data at 0x%x-0x%x overlaps the block at 0x%x", address, end-1, next.Address)
 		}
 	}
-	block := &IntelHexMemBlock{btype, address, make([]byte, len(data))}
-	copy(block.Data, data)
-	ihex.Blocks = append(ihex.Blocks, block)
 	ihex.Size += uint(len(data))
+
+	merge_prev := prev != nil && prev.Type == btype && prev.End() == address
+	merge_next := next != nil && next.Type == btype && next.Address == end
+	switch {
+	case merge_prev && merge_next:
+		prev.Data = append(append(prev.Data, data...), next.Data...)
+		ihex.Blocks = append(ihex.Blocks[:i], ihex.Blocks[i+1:]...)
+	case merge_prev:
+		prev.Data = append(prev.Data, data...)
+	case merge_next:
+		next.Data = append(append(make([]byte, 0, len(data)+len(next.Data)), data...), next.Data...)
+		next.Address = address
+	default:
+		block := &IntelHexMemBlock{btype, address, make([]byte, len(data))}
+		copy(block.Data, data)
+		ihex.Blocks = append(ihex.Blocks, nil)
+		copy(ihex.Blocks[i+1:], ihex.Blocks[i:])
+		ihex.Blocks[i] = block
+	}
+	return nil
 }
 
 func (ihex *IntelHex) Load(r io.Reader) error {
@@ -67,7 +112,11 @@ func (ihex *IntelHex) Load(r io.Reader) error {
 
 	for scanner.Scan() {
 		line_count++
-		line := scanner.Text()
+		// tolerate blank lines, as well as Windows line endings
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
 
 		if line[0] != ':' {
 			return fmt.Errorf("Missing ':' at the beginning of line %d", line_count)
@@ -92,7 +141,9 @@ func (ihex *IntelHex) Load(r io.Reader) error {
 		}
 		switch btype {
 		case 0:
-			ihex.Add(btype, extended_address+address, data[4:4+byte_count])
+			if err := ihex.Add(btype, extended_address+address, data[4:4+byte_count]); err != nil {
+				return fmt.Errorf("%s on line %d", err.Error(), line_count)
+			}
 		case 1:
 			if byte_count != 0 {
 				return fmt.Errorf("End of file marker has non zero length on line %d", line_count)
@@ -132,45 +183,59 @@ func (ihex *IntelHex) Load(r io.Reader) error {
 	return fmt.Errorf("Unexpected end of file on line %d", line_count)
 }
 
+func writeRecord(w io.Writer, rtype uint8, address uint16, data []byte) error {
+	checksum := uint8(len(data)) + uint8(address>>8) + uint8(address&0xFF) + rtype
+	for _, b := range data {
+		checksum += b
+	}
+	_, err := fmt.Fprintf(w, ":%02X%04X%02X%X%02X\n", len(data), address, rtype, data, (^checksum)+1)
+	return err
+}
+
+// Save writes the blocks as data records of up to 16 bytes, preceded by
+// extended linear address records where needed, and followed by an end of
+// file record.
 func (hex *IntelHex) Save(w io.Writer) error {
 	var extended_address uint32 = 0
-	var checksum uint8
 
 	for _, block := range hex.Blocks {
-
-		if extended_address != (block.Address >> 16) {
-			extended_address = (block.Address >> 16)
-			checksum = ^(0x02 + 0x00 + 0x00 + 0x04 + uint8(extended_address>>8) + uint8(extended_address&0xFF)) + 1
-			fmt.Fprintf(w, ":02000004%02X%02X%02X\n", (extended_address >> 8), (extended_address & 0xFF), checksum)
-		}
-
 		var pos uint32 = 0
 		var length uint32 = uint32(len(block.Data))
 		for pos < length {
-			var blen uint8
-			var i uint32
-
 			address := block.Address + pos
 
-			if length-pos < 16 {
-				blen = uint8(length - pos)
-			} else {
-				blen = 16
+			if extended_address != (address >> 16) {
+				extended_address = (address >> 16)
+				if err := writeRecord(w, 0x04, 0, []byte{uint8(extended_address >> 8), uint8(extended_address & 0xFF)}); err != nil {
+					return err
+				}
 			}
 
-			checksum = blen + uint8((address>>8)&0xFF) + uint8((address)&0xFF) + 0x00
-			fmt.Fprintf(w, ":%02X%02X%02X00", blen, ((address >> 8) & 0xFF), ((address) & 0xFF))
-			for i = 0; i < uint32(blen); i++ {
-				fmt.Fprintf(w, "%02X", block.Data[pos+i])
-				checksum += block.Data[pos+i]
+			blen := length - pos
+			if blen > 16 {
+				blen = 16
+			}
+			// records cannot cross a 64K boundary
+			if room := 0x10000 - (address & 0xFFFF); blen > room {
+				blen = room
 			}
-			fmt.Fprintf(w, "%02X\n", ((^checksum)+1)&0xFF)
-			pos += uint32(blen)
+			if err := writeRecord(w, 0x00, uint16(address&0xFFFF), block.Data[pos:pos+blen]); err != nil {
+				return err
+			}
+			pos += blen
 		}
 	}
-	return nil
+	return writeRecord(w, 0x01, 0, nil)
 }
 
-func (hex *IntelHex) IterateBlocks(fn func(uint8, uint32, []byte, interface{}) error, extra interface{}) {
-
+// IterateBlocks calls fn with the type, address and data of each block, in
+// address order, along with extra. It stops at the first error, which is
+// returned.
+func (hex *IntelHex) IterateBlocks(fn func(uint8, uint32, []byte, interface{}) error, extra interface{}) error {
+	for _, block := range hex.Blocks {
+		if err := fn(block.Type, block.Address, block.Data, extra); err != nil {
+			return err
+		}
+	}
+	return nil
 }
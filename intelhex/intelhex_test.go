@@ -0,0 +1,157 @@
+package intelhex
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func pattern(size int, seed byte) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = seed + byte(i)
+	}
+	return data
+}
+
+func TestSaveLoadRoundTrip(t *testing.T) {
+	ihex := New()
+	ihex.Add(0, 0x0000, pattern(100, 0x10))
+	ihex.Add(0, 0xFFF8, pattern(24, 0x20)) // crosses the first 64K boundary
+	ihex.Add(0, 0x20000, pattern(5, 0x30))
+
+	var buf bytes.Buffer
+	if err := ihex.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	text := buf.String()
+	if !strings.HasSuffix(text, ":00000001FF\n") {
+		t.Errorf("Missing end of file record at the end of:\n%s", text)
+	}
+	if !strings.Contains(text, ":020000040001F9\n") || !strings.Contains(text, ":020000040002F8\n") {
+		t.Errorf("Missing extended linear address records in:\n%s", text)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		// data records must stay within their 64K segment
+		count, address, rtype, err := recordHeader(line)
+		if err != nil {
+			t.Fatalf("Incorrect record %s: %s", line, err.Error())
+		}
+		if rtype == 0 && address+count > 0x10000 {
+			t.Errorf("Record %s crosses a 64K boundary", line)
+		}
+	}
+
+	loaded := New()
+	if err := loaded.Load(strings.NewReader(text)); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Size != ihex.Size || len(loaded.Blocks) != len(ihex.Blocks) {
+		t.Fatalf("Loaded %d bytes in %d blocks, expected %d bytes in %d blocks", loaded.Size, len(loaded.Blocks), ihex.Size, len(ihex.Blocks))
+	}
+	for i, block := range ihex.Blocks {
+		if loaded.Blocks[i].Address != block.Address || !bytes.Equal(loaded.Blocks[i].Data, block.Data) {
+			t.Errorf("Block %d differs: 0x%x %x, expected 0x%x %x", i, loaded.Blocks[i].Address, loaded.Blocks[i].Data, block.Address, block.Data)
+		}
+	}
+}
+
+// recordHeader decodes the length, address and type of a record.
+func recordHeader(line string) (uint32, uint32, uint8, error) {
+	if len(line) < 11 || line[0] != ':' {
+		return 0, 0, 0, fmt.Errorf("record is too short")
+	}
+	header, err := hex.DecodeString(line[1:9])
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return uint32(header[0]), uint32(header[1])<<8 | uint32(header[2]), header[3], nil
+}
+
+func TestLoadEndOfFile(t *testing.T) {
+	ihex := New()
+	if err := ihex.Load(strings.NewReader(":0400000001020304F2\n")); err == nil {
+		t.Errorf("File without an end of file record was accepted")
+	}
+
+	// anything after the end of file record is ignored
+	ihex = New()
+	if err := ihex.Load(strings.NewReader(":0400000001020304F2\r\n\n:00000001FF\r\nrubbish\n")); err != nil {
+		t.Fatal(err)
+	}
+	if len(ihex.Blocks) != 1 || !bytes.Equal(ihex.Blocks[0].Data, []byte{1, 2, 3, 4}) {
+		t.Errorf("Unexpected content %+v", ihex.Blocks)
+	}
+
+	ihex = New()
+	if err := ihex.Load(strings.NewReader(":0400000001020304F3\n:00000001FF\n")); err == nil {
+		t.Errorf("Record with an incorrect checksum was accepted")
+	}
+}
+
+func TestAddMerge(t *testing.T) {
+	ihex := New()
+	ihex.Add(0, 16, pattern(8, 16))
+	ihex.Add(0, 0, pattern(8, 0))
+	if len(ihex.Blocks) != 2 || ihex.Blocks[0].Address != 0 {
+		t.Fatalf("Blocks are not kept in address order")
+	}
+
+	// fills the gap between the two blocks, which become one
+	ihex.Add(0, 8, pattern(8, 8))
+	if len(ihex.Blocks) != 1 || !bytes.Equal(ihex.Blocks[0].Data, pattern(24, 0)) {
+		t.Fatalf("Adjacent blocks were not merged: %+v", ihex.Blocks)
+	}
+
+	// data preceding a block is merged with it
+	ihex.Add(0, 32, pattern(8, 32))
+	ihex.Add(0, 24, pattern(8, 24))
+	if len(ihex.Blocks) != 1 || !bytes.Equal(ihex.Blocks[0].Data, pattern(40, 0)) {
+		t.Fatalf("Preceding data was not merged: %+v", ihex.Blocks)
+	}
+
+	// blocks of different types stay apart
+	ihex.Add(1, 40, pattern(4, 40))
+	if len(ihex.Blocks) != 2 {
+		t.Errorf("Blocks of different types were merged")
+	}
+	if ihex.Size != 44 {
+		t.Errorf("Size is %d, expected 44", ihex.Size)
+	}
+}
+
+func TestAddOverlap(t *testing.T) {
+	ihex := New()
+	ihex.Add(0, 0x100, pattern(16, 0))
+
+	for _, address := range []uint32{0xF9, 0x100, 0x108, 0x10F} {
+		if err := ihex.Add(0, address, pattern(8, 0)); err == nil {
+			t.Errorf("Data at 0x%x overlapping 0x100-0x10F was accepted", address)
+		}
+	}
+	if err := ihex.Add(0, 0xF0, pattern(0x20, 0)); err == nil {
+		t.Errorf("Data covering the whole block was accepted")
+	}
+	if ihex.Size != 16 || len(ihex.Blocks) != 1 || len(ihex.Blocks[0].Data) != 16 {
+		t.Errorf("Refused data changed the content: %+v", ihex.Blocks)
+	}
+}
+
+func TestAddOverflow(t *testing.T) {
+	ihex := New()
+
+	if err := ihex.Add(0, 0xFFFFFF00, pattern(0x100, 0)); err == nil {
+		t.Errorf("Data ending at 0x100000000 was accepted")
+	}
+	if err := ihex.LoadBinary(bytes.NewReader(pattern(0x200, 0)), 0xFFFFFF00); err == nil {
+		t.Errorf("Binary image wrapping around the address space was accepted")
+	}
+	if len(ihex.Blocks) != 0 || ihex.Size != 0 {
+		t.Errorf("Refused data changed the content: %+v", ihex.Blocks)
+	}
+	if err := ihex.Add(0, 0xFFFFFF00, pattern(0xFF, 0)); err != nil {
+		t.Errorf("Data ending at 0xFFFFFFFE was refused: %s", err.Error())
+	}
+}
@@ -90,11 +90,11 @@ func (canid CanId) IsExtended() bool {
 }
 
 func (canid CanId) IsError() bool {
-	return (canid >> CANID_MASK_ERROR) != 0
+	return (canid & CANID_MASK_ERROR) != 0
 }
 
 func (canid CanId) IsRemote() bool {
-	return (canid >> CANID_MASK_REMOTE) != 0
+	return (canid & CANID_MASK_REMOTE) != 0
 }
 
 func (canid CanId) IsControl() bool {
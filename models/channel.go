@@ -1,12 +1,19 @@
 package models
 
 import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"pannetrat.com/nocan/clog"
 	"sync"
 	"time"
 )
 
+const CHANNEL_SAVE_INTERVAL = 10 * time.Second
+
 type Channel int16
 
 type ChannelState struct {
@@ -14,15 +21,20 @@ type ChannelState struct {
 	Name        string
 	ValueLength int
 	Value       [64]byte
+	Type        ChannelType
 	UpdatedAt   time.Time
+	Owner       Node   // node that registered the channel, 0 for the manager
+	Template    string // name before keyword expansion
 }
 
 type ChannelModel struct {
-	Mutex  sync.RWMutex
-	ById   map[Channel]*ChannelState
-	ByName map[string]*ChannelState
-	Port   *Port
-	TopId  Channel
+	Mutex       sync.RWMutex
+	ById        map[Channel]*ChannelState
+	ByName      map[string]*ChannelState
+	Port        *Port
+	TopId       Channel
+	ChannelFile string
+	Modified    bool
 }
 
 func NewChannelModel() *ChannelModel {
@@ -44,16 +56,107 @@ func (tm *ChannelModel) Each(fn func(Channel, *ChannelState)) {
 	}
 }
 
+type ChannelInfo struct {
+	Channel   Channel     `json:"channel"`
+	Value     string      `json:"value"`
+	Type      ChannelType `json:"type,omitempty"`
+	UpdatedAt time.Time   `json:"updated_at"`
+	Owner     Node        `json:"owner,omitempty"`
+	Template  string      `json:"template,omitempty"`
+}
+
+func (tm *ChannelModel) LoadFromFile(channelfile string) error {
+	info := make(map[string]ChannelInfo)
+
+	tm.Mutex.Lock()
+	defer tm.Mutex.Unlock()
+
+	tm.ChannelFile = channelfile
+	data, err := ioutil.ReadFile(channelfile)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(data, &info)
+	if err != nil {
+		clog.Fatal("JSON parsing error in %s: %s", channelfile, err.Error())
+	}
+
+	for k, v := range info {
+		if _, ok := tm.ById[v.Channel]; ok || v.Channel < 0 {
+			clog.Warning("Channel %d appears twice or is invalid in %s, channel %s will be ignored", v.Channel, channelfile, k)
+			continue
+		}
+		state := &ChannelState{ChannelId: v.Channel, Name: k, UpdatedAt: v.UpdatedAt, Owner: v.Owner, Template: v.Template}
+		if state.Type, err = ParseChannelType(string(v.Type)); err != nil {
+			clog.Warning("Ignoring type of channel %s in %s: %s", k, channelfile, err.Error())
+		}
+		value, err := hex.DecodeString(v.Value)
+		if err != nil || len(value) > 64 {
+			clog.Warning("Ignoring incorrect value of channel %s in %s", k, channelfile)
+		} else {
+			copy(state.Value[:], value)
+			state.ValueLength = len(value)
+		}
+		clog.Debug("Pre-registering channel %s as %d", k, v.Channel)
+		tm.ById[v.Channel] = state
+		tm.ByName[k] = state
+		if v.Channel >= tm.TopId {
+			tm.TopId = v.Channel + 1
+		}
+	}
+	return nil
+}
+
+func (tm *ChannelModel) SaveToFile() error {
+	info := make(map[string]ChannelInfo)
+
+	tm.Mutex.Lock()
+	defer tm.Mutex.Unlock()
+
+	if tm.ChannelFile == "" {
+		return nil
+	}
+
+	for k, v := range tm.ByName {
+		info[k] = ChannelInfo{Channel: v.ChannelId, Value: hex.EncodeToString(v.Value[:v.ValueLength]), Type: v.Type, UpdatedAt: v.UpdatedAt, Owner: v.Owner, Template: v.Template}
+	}
+
+	js, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(tm.ChannelFile, js, 0644); err != nil {
+		return err
+	}
+	tm.Modified = false
+	return nil
+}
+
+func (tm *ChannelModel) saveChanges() {
+	if err := tm.SaveToFile(); err != nil {
+		clog.Warning("Failed to save channel info: %s", err.Error())
+	}
+}
+
 func (tm *ChannelModel) Register(channelName string) (Channel, error) {
+	channel, created, err := tm.register(channelName)
+	if created {
+		tm.saveChanges()
+	}
+	return channel, err
+}
+
+func (tm *ChannelModel) register(channelName string) (Channel, bool, error) {
 	if len(channelName) == 0 {
-		return Channel(-1), errors.New("Channel cannot be empty")
+		return Channel(-1), false, errors.New("Channel cannot be empty")
 	}
 
 	tm.Mutex.Lock()
 	defer tm.Mutex.Unlock()
 
 	if state, ok := tm.ByName[channelName]; ok {
-		return state.ChannelId, nil
+		return state.ChannelId, false, nil
 	}
 
 	for {
@@ -65,15 +168,53 @@ func (tm *ChannelModel) Register(channelName string) (Channel, error) {
 			tm.ById[tm.TopId] = state
 			tm.ByName[channelName] = state
 			tm.TopId++
-			return state.ChannelId, nil
+			return state.ChannelId, true, nil
 		}
 		tm.TopId++
 	}
 	// never reached
-	return Channel(-1), errors.New("Maximum numver of channels has been reached")
+	return Channel(-1), false, errors.New("Maximum numver of channels has been reached")
 }
 
-func (tm *ChannelModel) Unregister(channel Channel) bool {
+// Declare registers a channel if needed and sets the type of its value.
+func (tm *ChannelModel) Declare(channelName string, channelType ChannelType) (Channel, error) {
+	channel, _, err := tm.register(channelName)
+	if err != nil {
+		return channel, err
+	}
+	tm.SetType(channel, channelType)
+	return channel, nil
+}
+
+func (tm *ChannelModel) SetType(channel Channel, channelType ChannelType) bool {
+	tm.Mutex.Lock()
+
+	ts := tm.getState(channel)
+	if ts == nil {
+		tm.Mutex.Unlock()
+		return false
+	}
+	ts.Type = channelType
+	tm.Mutex.Unlock()
+
+	tm.saveChanges()
+	return true
+}
+
+func (tm *ChannelModel) GetType(channel Channel) (ChannelType, bool) {
+	tm.Mutex.RLock()
+	defer tm.Mutex.RUnlock()
+
+	ts := tm.getState(channel)
+	if ts == nil {
+		return CHANNEL_TYPE_NONE, false
+	}
+	return ts.Type, true
+}
+
+// SetOwner records the node that registered a channel, and the name it used
+// before keyword expansion.
+func (tm *ChannelModel) SetOwner(channel Channel, node Node, template string) bool {
 	tm.Mutex.Lock()
 	defer tm.Mutex.Unlock()
 
@@ -81,9 +222,92 @@ func (tm *ChannelModel) Unregister(channel Channel) bool {
 	if ts == nil {
 		return false
 	}
+	if ts.Owner != node || ts.Template != template {
+		ts.Owner = node
+		ts.Template = template
+		tm.Modified = true
+	}
+	return true
+}
+
+func (tm *ChannelModel) Rename(channel Channel, channelName string) error {
+	if len(channelName) == 0 {
+		return errors.New("Channel cannot be empty")
+	}
+
+	tm.Mutex.Lock()
+
+	ts := tm.getState(channel)
+	if ts == nil {
+		tm.Mutex.Unlock()
+		return fmt.Errorf("Channel %d does not exist", channel)
+	}
+	if other, ok := tm.ByName[channelName]; ok && other != ts {
+		tm.Mutex.Unlock()
+		return fmt.Errorf("Channel %s already exists", channelName)
+	}
+	delete(tm.ByName, ts.Name)
+	ts.Name = channelName
+	tm.ByName[channelName] = ts
+	tm.Mutex.Unlock()
+
+	tm.saveChanges()
+	return nil
+}
+
+// ExpandNodeChannels expands again the names of the channels registered by a
+// node, typically after its attributes changed, and renames the channels
+// whose name changed. It returns a map of old names to new names.
+func (tm *ChannelModel) ExpandNodeChannels(node Node) map[string]string {
+	templates := make(map[Channel]string)
+	names := make(map[Channel]string)
+
+	tm.Mutex.RLock()
+	for k, v := range tm.ById {
+		if v.Owner == node && node != 0 && v.Template != "" {
+			templates[k] = v.Template
+			names[k] = v.Name
+		}
+	}
+	tm.Mutex.RUnlock()
+
+	renamed := make(map[string]string)
+	for channel, template := range templates {
+		expanded, ok := Nodes.ExpandKeywords(node, template)
+		if !ok {
+			clog.Warning("Failed to expand channel name '%s' for node %d", template, node)
+			continue
+		}
+		if expanded == names[channel] {
+			continue
+		}
+		if err := tm.Rename(channel, expanded); err != nil {
+			clog.Warning("Failed to rename channel %s to %s: %s", names[channel], expanded, err.Error())
+			continue
+		}
+		clog.Info("Renamed channel %s to %s for node %d", names[channel], expanded, node)
+		renamed[names[channel]] = expanded
+	}
+	return renamed
+}
+
+func (tm *ChannelModel) Unregister(channel Channel) bool {
+	tm.Mutex.Lock()
+
+	ts := tm.getState(channel)
+	if ts == nil {
+		tm.Mutex.Unlock()
+		return false
+	}
 	delete(tm.ByName, ts.Name)
 	delete(tm.ById, ts.ChannelId)
 	ts.Name = ""
+	tm.Mutex.Unlock()
+
+	if err := History.Remove(channel); err != nil {
+		clog.Warning("Failed to remove history of channel %d: %s", channel, err.Error())
+	}
+	tm.saveChanges()
 	return true
 }
 
@@ -97,6 +321,17 @@ func (tm *ChannelModel) Lookup(channelName string) (Channel, bool) {
 	return Channel(-1), false
 }
 
+func (tm *ChannelModel) GetName(channel Channel) (string, bool) {
+	tm.Mutex.RLock()
+	defer tm.Mutex.RUnlock()
+
+	ts := tm.getState(channel)
+	if ts == nil {
+		return "", false
+	}
+	return ts.Name, true
+}
+
 func (tm *ChannelModel) GetContent(channel Channel) ([]byte, bool) {
 	tm.Mutex.RLock()
 	defer tm.Mutex.RUnlock()
@@ -108,27 +343,65 @@ func (tm *ChannelModel) GetContent(channel Channel) ([]byte, bool) {
 	return ts.Value[:ts.ValueLength], true
 }
 
-func (tm *ChannelModel) SetContent(channel Channel, content []byte) bool {
+// GetState returns a copy of the state of a channel.
+func (tm *ChannelModel) GetState(channel Channel) (ChannelState, bool) {
+	tm.Mutex.RLock()
+	defer tm.Mutex.RUnlock()
+
+	ts := tm.getState(channel)
+	if ts == nil {
+		return ChannelState{}, false
+	}
+	return *ts, true
+}
+
+// SetContent updates the value of a channel, as published by the given node
+// (0 for the manager itself), and records it in the channel history.
+func (tm *ChannelModel) SetContent(channel Channel, node Node, content []byte) bool {
 	tm.Mutex.Lock()
-	defer tm.Mutex.Unlock()
 
 	ts := tm.getState(channel)
 	if ts == nil || len(content) > 64 {
+		tm.Mutex.Unlock()
 		return false
 	}
 	copy(ts.Value[:], content)
 	ts.ValueLength = len(content)
+	ts.UpdatedAt = time.Now()
+	tm.Modified = true
+	tm.Mutex.Unlock()
+
+	if err := History.Append(channel, node, content); err != nil {
+		clog.Warning("Failed to record history of channel %d: %s", channel, err.Error())
+	}
 	return true
 }
 
 func (tm *ChannelModel) Publish(channel Channel, content []byte) bool {
-	if tm.SetContent(channel, content) {
+	if tm.SetContent(channel, 0, content) {
 		tm.Port.SendMessage(NewPublishMessage(0, channel, content))
 		return true
 	}
 	return false
 }
 
+// PublishValue encodes a textual value according to the type of the
+// channel and publishes it.
+func (tm *ChannelModel) PublishValue(channel Channel, value string) error {
+	channelType, ok := tm.GetType(channel)
+	if !ok {
+		return fmt.Errorf("Channel %d does not exist", channel)
+	}
+	content, err := channelType.Encode(value)
+	if err != nil {
+		return err
+	}
+	if !tm.Publish(channel, content) {
+		return fmt.Errorf("Failed to publish to channel %d", channel)
+	}
+	return nil
+}
+
 func (tm *ChannelModel) getState(channel Channel) *ChannelState {
 	if state, ok := tm.ById[channel]; ok {
 		return state
@@ -145,13 +418,38 @@ func BytesToChannel(block []uint8) Channel {
 	return (Channel(block[0]) << 8) | Channel(block[1])
 }
 
-func (tm *ChannelModel) Run() {
+// Run processes channel messages until ctx is cancelled, and saves pending
+// changes before returning.
+func (tm *ChannelModel) Run(ctx context.Context) {
 	var channel_id Channel
 	var channel_bytes [2]uint8
 	var status uint8
+	var m *Message
+
+	ticker := time.NewTicker(CHANNEL_SAVE_INTERVAL)
+	defer ticker.Stop()
 
 	for {
-		m := <-tm.Port.Input
+		select {
+		case m = <-tm.Port.Input:
+		case <-ctx.Done():
+			tm.Mutex.RLock()
+			modified := tm.Modified
+			tm.Mutex.RUnlock()
+			if modified {
+				tm.saveChanges()
+			}
+			return
+		case <-ticker.C:
+			// values are saved periodically rather than on every update
+			tm.Mutex.RLock()
+			modified := tm.Modified
+			tm.Mutex.RUnlock()
+			if modified {
+				tm.saveChanges()
+			}
+			continue
+		}
 
 		if m.Id.IsSystem() {
 			switch m.Id.GetSysFunc() {
@@ -169,6 +467,7 @@ func (tm *ChannelModel) Run() {
 						clog.Warning("NOCAN_SYS_CHANNEL_REGISTER: Failed to register channel %s (expanded from %s) for node %d, %s", channel_expanded, string(m.Data), m.Id.GetNode(), err.Error())
 					} else {
 						clog.Info("NOCAN_SYS_CHANNEL_REGISTER: Registered channel %s for node %d as %d", channel_expanded, m.Id.GetNode(), channel_id)
+						tm.SetOwner(channel_id, m.Id.GetNode(), string(m.Data))
 						ChannelToBytes(channel_id, channel_bytes[:])
 						status = 0x00
 					}
@@ -202,7 +501,7 @@ func (tm *ChannelModel) Run() {
 				tm.Port.SendMessage(msg)
 			}
 		} else if m.Id.IsPublish() {
-			tm.SetContent(m.Id.GetChannel(), m.Data)
+			tm.SetContent(m.Id.GetChannel(), m.Id.GetNode(), m.Data)
 		}
 	}
 
@@ -0,0 +1,205 @@
+package models
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ChannelType describes how the raw bytes of a channel value are encoded.
+// Channels without a declared type (CHANNEL_TYPE_NONE) behave as before:
+// values are written as text or as hexadecimal with a '#' prefix.
+type ChannelType string
+
+const (
+	CHANNEL_TYPE_NONE      ChannelType = ""
+	CHANNEL_TYPE_UTF8      ChannelType = "utf8"
+	CHANNEL_TYPE_INT8      ChannelType = "int8"
+	CHANNEL_TYPE_INT16BE   ChannelType = "int16be"
+	CHANNEL_TYPE_INT16LE   ChannelType = "int16le"
+	CHANNEL_TYPE_INT32BE   ChannelType = "int32be"
+	CHANNEL_TYPE_INT32LE   ChannelType = "int32le"
+	CHANNEL_TYPE_FLOAT32BE ChannelType = "float32be"
+	CHANNEL_TYPE_FLOAT32LE ChannelType = "float32le"
+	CHANNEL_TYPE_BOOL      ChannelType = "bool"
+	CHANNEL_TYPE_BYTES     ChannelType = "bytes"
+	CHANNEL_TYPE_JSON      ChannelType = "json"
+)
+
+var channelTypeAliases = map[string]ChannelType{
+	"float32": CHANNEL_TYPE_FLOAT32LE, // native byte order of AVR nodes
+	"string":  CHANNEL_TYPE_UTF8,
+	"hex":     CHANNEL_TYPE_BYTES,
+}
+
+func ParseChannelType(s string) (ChannelType, error) {
+	s = strings.ToLower(s)
+	if t, ok := channelTypeAliases[s]; ok {
+		return t, nil
+	}
+	switch ChannelType(s) {
+	case CHANNEL_TYPE_NONE, CHANNEL_TYPE_UTF8, CHANNEL_TYPE_INT8,
+		CHANNEL_TYPE_INT16BE, CHANNEL_TYPE_INT16LE, CHANNEL_TYPE_INT32BE, CHANNEL_TYPE_INT32LE,
+		CHANNEL_TYPE_FLOAT32BE, CHANNEL_TYPE_FLOAT32LE, CHANNEL_TYPE_BOOL, CHANNEL_TYPE_BYTES, CHANNEL_TYPE_JSON:
+		return ChannelType(s), nil
+	}
+	return CHANNEL_TYPE_NONE, fmt.Errorf("Unknown channel type '%s'", s)
+}
+
+func (t ChannelType) byteOrder() binary.ByteOrder {
+	if strings.HasSuffix(string(t), "le") {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+// Encode converts a textual value (e.g. from a form or MQTT) to raw bytes.
+func (t ChannelType) Encode(value string) ([]byte, error) {
+	var data []byte
+
+	switch t {
+	case CHANNEL_TYPE_NONE:
+		if len(value) > 1 && value[0] == '#' {
+			var err error
+			if data, err = hex.DecodeString(value[1:]); err != nil {
+				return nil, fmt.Errorf("Error decoding hexadecimal string: %s", err.Error())
+			}
+		} else {
+			data = []byte(value)
+		}
+	case CHANNEL_TYPE_UTF8:
+		if !utf8.ValidString(value) {
+			return nil, fmt.Errorf("Value is not a valid UTF-8 string")
+		}
+		data = []byte(value)
+	case CHANNEL_TYPE_INT8:
+		v, err := strconv.ParseInt(value, 0, 8)
+		if err != nil {
+			return nil, err
+		}
+		data = []byte{byte(v)}
+	case CHANNEL_TYPE_INT16BE, CHANNEL_TYPE_INT16LE:
+		v, err := strconv.ParseInt(value, 0, 16)
+		if err != nil {
+			return nil, err
+		}
+		data = make([]byte, 2)
+		t.byteOrder().PutUint16(data, uint16(v))
+	case CHANNEL_TYPE_INT32BE, CHANNEL_TYPE_INT32LE:
+		v, err := strconv.ParseInt(value, 0, 32)
+		if err != nil {
+			return nil, err
+		}
+		data = make([]byte, 4)
+		t.byteOrder().PutUint32(data, uint32(v))
+	case CHANNEL_TYPE_FLOAT32BE, CHANNEL_TYPE_FLOAT32LE:
+		v, err := strconv.ParseFloat(value, 32)
+		if err != nil {
+			return nil, err
+		}
+		data = make([]byte, 4)
+		t.byteOrder().PutUint32(data, math.Float32bits(float32(v)))
+	case CHANNEL_TYPE_BOOL:
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, err
+		}
+		if v {
+			data = []byte{1}
+		} else {
+			data = []byte{0}
+		}
+	case CHANNEL_TYPE_BYTES:
+		var err error
+		if data, err = hex.DecodeString(strings.TrimPrefix(value, "#")); err != nil {
+			return nil, fmt.Errorf("Error decoding hexadecimal string: %s", err.Error())
+		}
+	case CHANNEL_TYPE_JSON:
+		if !json.Valid([]byte(value)) {
+			return nil, fmt.Errorf("Value is not valid JSON")
+		}
+		data = []byte(value)
+	default:
+		return nil, fmt.Errorf("Unknown channel type '%s'", t)
+	}
+	if len(data) > 64 {
+		return nil, fmt.Errorf("Encoded value is %d bytes long, which exceeds the 64 bytes limit", len(data))
+	}
+	return data, nil
+}
+
+func (t ChannelType) checkLength(data []byte, expected int) error {
+	if len(data) != expected {
+		return fmt.Errorf("Value of type %s should be %d bytes long, got %d", t, expected, len(data))
+	}
+	return nil
+}
+
+// Decode converts raw bytes to a value suitable for JSON encoding.
+func (t ChannelType) Decode(data []byte) (interface{}, error) {
+	switch t {
+	case CHANNEL_TYPE_NONE:
+		return string(data), nil
+	case CHANNEL_TYPE_UTF8:
+		if !utf8.Valid(data) {
+			return nil, fmt.Errorf("Value is not a valid UTF-8 string")
+		}
+		return string(data), nil
+	case CHANNEL_TYPE_INT8:
+		if err := t.checkLength(data, 1); err != nil {
+			return nil, err
+		}
+		return int8(data[0]), nil
+	case CHANNEL_TYPE_INT16BE, CHANNEL_TYPE_INT16LE:
+		if err := t.checkLength(data, 2); err != nil {
+			return nil, err
+		}
+		return int16(t.byteOrder().Uint16(data)), nil
+	case CHANNEL_TYPE_INT32BE, CHANNEL_TYPE_INT32LE:
+		if err := t.checkLength(data, 4); err != nil {
+			return nil, err
+		}
+		return int32(t.byteOrder().Uint32(data)), nil
+	case CHANNEL_TYPE_FLOAT32BE, CHANNEL_TYPE_FLOAT32LE:
+		if err := t.checkLength(data, 4); err != nil {
+			return nil, err
+		}
+		v := math.Float32frombits(t.byteOrder().Uint32(data))
+		if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+			return nil, fmt.Errorf("Value is not a finite number")
+		}
+		return v, nil
+	case CHANNEL_TYPE_BOOL:
+		if err := t.checkLength(data, 1); err != nil {
+			return nil, err
+		}
+		return data[0] != 0, nil
+	case CHANNEL_TYPE_BYTES:
+		return hex.EncodeToString(data), nil
+	case CHANNEL_TYPE_JSON:
+		if !json.Valid(data) {
+			return nil, fmt.Errorf("Value is not valid JSON")
+		}
+		return json.RawMessage(append([]byte(nil), data...)), nil
+	}
+	return nil, fmt.Errorf("Unknown channel type '%s'", t)
+}
+
+// Format returns the textual representation of a value, in the form
+// accepted by Encode.
+func (t ChannelType) Format(data []byte) (string, error) {
+	switch t {
+	case CHANNEL_TYPE_NONE, CHANNEL_TYPE_UTF8, CHANNEL_TYPE_JSON:
+		return string(data), nil
+	}
+	v, err := t.Decode(data)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprint(v), nil
+}
@@ -0,0 +1,95 @@
+package models
+
+import (
+	"encoding/hex"
+	"pannetrat.com/nocan/clog"
+	"sync"
+	"time"
+)
+
+// MessageEvent is the decoded form of a message, as streamed to API clients.
+type MessageEvent struct {
+	Time      time.Time `json:"time"`
+	Interface int       `json:"interface"`
+	Node      Node      `json:"node"`
+	System    bool      `json:"system"`
+	Function  string    `json:"function,omitempty"`
+	Param     uint8     `json:"param"`
+	ChannelId Channel   `json:"channel_id"`
+	Channel   string    `json:"channel,omitempty"`
+	DataHex   string    `json:"data_hex"`
+	DataText  string    `json:"data_text"`
+}
+
+func NewMessageEvent(m *Message) *MessageEvent {
+	ev := &MessageEvent{
+		Time:      time.Now(),
+		Interface: Interfaces.InterfaceIdOf(m),
+		Node:      m.Id.GetNode(),
+		System:    m.Id.IsSystem(),
+		ChannelId: -1,
+		DataHex:   hex.EncodeToString(m.Data),
+	}
+
+	if ev.System {
+		ev.Function = NocanSysFuncString(m.Id.GetSysFunc())
+		ev.Param = m.Id.GetSysParam()
+	} else {
+		ev.ChannelId = m.Id.GetChannel()
+		ev.Channel, _ = Channels.GetName(ev.ChannelId)
+	}
+
+	ev.DataText = DataToText(m.Data)
+	return ev
+}
+
+// Event is a notification emitted by the models, such as a change in the
+// status of a node, as opposed to messages seen on the bus.
+type Event struct {
+	Type string
+	Data interface{}
+}
+
+// EventModel dispatches events to listeners. Events are dropped for
+// listeners that don't keep up.
+type EventModel struct {
+	Mutex     sync.Mutex
+	listeners map[chan *Event]bool
+}
+
+func NewEventModel() *EventModel {
+	return &EventModel{listeners: make(map[chan *Event]bool)}
+}
+
+func (em *EventModel) Subscribe(size int) chan *Event {
+	em.Mutex.Lock()
+	defer em.Mutex.Unlock()
+
+	listener := make(chan *Event, size)
+	em.listeners[listener] = true
+	return listener
+}
+
+func (em *EventModel) Unsubscribe(listener chan *Event) {
+	em.Mutex.Lock()
+	defer em.Mutex.Unlock()
+
+	if em.listeners[listener] {
+		delete(em.listeners, listener)
+		close(listener)
+	}
+}
+
+func (em *EventModel) Emit(eventType string, data interface{}) {
+	em.Mutex.Lock()
+	defer em.Mutex.Unlock()
+
+	event := &Event{Type: eventType, Data: data}
+	for listener := range em.listeners {
+		select {
+		case listener <- event:
+		default:
+			clog.Warning("Dropping %s event for a slow listener", eventType)
+		}
+	}
+}
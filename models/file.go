@@ -0,0 +1,35 @@
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic writes data to a temporary file in the same directory as
+// filename, and renames it once it is safely on disk, so that an interrupted
+// write never leaves a truncated file behind.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	file, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpname := file.Name()
+
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmpname, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmpname, filename)
+	}
+	if err != nil {
+		os.Remove(tmpname)
+	}
+	return err
+}
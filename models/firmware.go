@@ -0,0 +1,250 @@
+package models
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"pannetrat.com/nocan/clog"
+	"pannetrat.com/nocan/intelhex"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+const FIRMWARE_INDEX_FILE = "index.json"
+
+var firmwareNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+type FirmwareImage struct {
+	Name       string    `json:"name"`
+	Version    string    `json:"version"`
+	Size       uint32    `json:"size"`
+	Sha256     string    `json:"sha256"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// Id returns the "name@version" string recorded on nodes running the image.
+func (image *FirmwareImage) Id() string {
+	return image.Name + "@" + image.Version
+}
+
+func (image *FirmwareImage) fileName() string {
+	return image.Name + "-" + image.Version + ".hex"
+}
+
+// FirmwareModel stores named and versioned Intel HEX images in a directory,
+// along with an index file describing them.
+type FirmwareModel struct {
+	Mutex     sync.RWMutex
+	Directory string
+	Images    map[string]*FirmwareImage
+}
+
+func NewFirmwareModel() *FirmwareModel {
+	return &FirmwareModel{Images: make(map[string]*FirmwareImage)}
+}
+
+func (fm *FirmwareModel) Open(directory string) error {
+	fm.Mutex.Lock()
+	defer fm.Mutex.Unlock()
+
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return err
+	}
+	fm.Directory = directory
+
+	data, err := ioutil.ReadFile(filepath.Join(directory, FIRMWARE_INDEX_FILE))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var images []*FirmwareImage
+	if err = json.Unmarshal(data, &images); err != nil {
+		return fmt.Errorf("JSON parsing error in %s: %s", FIRMWARE_INDEX_FILE, err.Error())
+	}
+	for _, image := range images {
+		fm.Images[image.Id()] = image
+	}
+	return nil
+}
+
+// saveIndex must be called with the lock held.
+func (fm *FirmwareModel) saveIndex() error {
+	images := make([]*FirmwareImage, 0, len(fm.Images))
+	for _, image := range fm.Images {
+		images = append(images, image)
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Id() < images[j].Id() })
+
+	js, err := json.MarshalIndent(images, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(fm.Directory, FIRMWARE_INDEX_FILE), js, 0644)
+}
+
+func (fm *FirmwareModel) List() []FirmwareImage {
+	fm.Mutex.RLock()
+	defer fm.Mutex.RUnlock()
+
+	images := make([]FirmwareImage, 0, len(fm.Images))
+	for _, image := range fm.Images {
+		images = append(images, *image)
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Id() < images[j].Id() })
+	return images
+}
+
+func (fm *FirmwareModel) Find(name string, version string) (*FirmwareImage, bool) {
+	fm.Mutex.RLock()
+	defer fm.Mutex.RUnlock()
+
+	image, ok := fm.Images[name+"@"+version]
+	return image, ok
+}
+
+// Add stores a new image, which must be a valid Intel HEX file. Existing
+// versions cannot be overwritten.
+func (fm *FirmwareModel) Add(name string, version string, data []byte) (*FirmwareImage, error) {
+	if !firmwareNamePattern.MatchString(name) || !firmwareNamePattern.MatchString(version) {
+		return nil, fmt.Errorf("Firmware names and versions may only contain letters, digits, '.', '_' and '-'")
+	}
+
+	ihex := intelhex.New()
+	if err := ihex.Load(bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("Failed to parse firmware: %s", err.Error())
+	}
+
+	fm.Mutex.Lock()
+	defer fm.Mutex.Unlock()
+
+	if fm.Directory == "" {
+		return nil, fmt.Errorf("Firmware repository is not enabled")
+	}
+	image := &FirmwareImage{Name: name, Version: version, Size: uint32(ihex.Size), UploadedAt: time.Now()}
+	if _, ok := fm.Images[image.Id()]; ok {
+		return nil, fmt.Errorf("Firmware %s already exists", image.Id())
+	}
+	sum := sha256.Sum256(data)
+	image.Sha256 = hex.EncodeToString(sum[:])
+
+	if err := writeFileAtomic(filepath.Join(fm.Directory, image.fileName()), data, 0644); err != nil {
+		return nil, err
+	}
+	fm.Images[image.Id()] = image
+	if err := fm.saveIndex(); err != nil {
+		return nil, err
+	}
+	clog.Info("Added firmware %s (%d bytes)", image.Id(), image.Size)
+	return image, nil
+}
+
+func (fm *FirmwareModel) Remove(name string, version string) bool {
+	fm.Mutex.Lock()
+	defer fm.Mutex.Unlock()
+
+	image, ok := fm.Images[name+"@"+version]
+	if !ok {
+		return false
+	}
+	delete(fm.Images, image.Id())
+	if err := os.Remove(filepath.Join(fm.Directory, image.fileName())); err != nil {
+		clog.Warning("Failed to remove firmware file %s: %s", image.fileName(), err.Error())
+	}
+	if err := fm.saveIndex(); err != nil {
+		clog.Warning("Failed to save firmware index: %s", err.Error())
+	}
+	return true
+}
+
+// ReadFile returns the Intel HEX file of an image.
+func (fm *FirmwareModel) ReadFile(image *FirmwareImage) ([]byte, error) {
+	fm.Mutex.RLock()
+	defer fm.Mutex.RUnlock()
+
+	return ioutil.ReadFile(filepath.Join(fm.Directory, image.fileName()))
+}
+
+// Lookup finds an image from its "name@version" id.
+func (fm *FirmwareModel) Lookup(id string) (*FirmwareImage, bool) {
+	fm.Mutex.RLock()
+	defer fm.Mutex.RUnlock()
+
+	image, ok := fm.Images[id]
+	return image, ok
+}
+
+func (fm *FirmwareModel) Load(image *FirmwareImage) (*intelhex.IntelHex, error) {
+	data, err := fm.ReadFile(image)
+	if err != nil {
+		return nil, err
+	}
+	ihex := intelhex.New()
+	if err = ihex.Load(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	return ihex, nil
+}
+
+type RolloutNodeResult struct {
+	Node   Node          `json:"node"`
+	Udid   string        `json:"udid"`
+	Report *UploadReport `json:"report"`
+}
+
+// RolloutReport is the result of a rollout job.
+type RolloutReport struct {
+	Firmware string              `json:"firmware"`
+	Nodes    []RolloutNodeResult `json:"nodes"`
+}
+
+// Rollout flashes an image on each node in turn, stopping on the first
+// failure, and records the version running on each updated node. The nodes
+// must have been reserved with Reserve, see JobModel.CreateNodeJob.
+func (fm *FirmwareModel) Rollout(state *JobState, image *FirmwareImage, nodes []Node, delta bool) error {
+	ihex, err := fm.Load(image)
+	if err != nil {
+		state.Fail(err)
+		return err
+	}
+
+	report := &RolloutReport{Firmware: image.Id(), Nodes: make([]RolloutNodeResult, 0, len(nodes))}
+	for i, node := range nodes {
+		if state.Context.Err() != nil {
+			err := fmt.Errorf("Rollout of %s was cancelled after updating %d of %d nodes", image.Id(), i, len(nodes))
+			state.Fail(err)
+			return err
+		}
+		clog.Info("Rollout of %s: flashing node %d (%d of %d)", image.Id(), node, i+1, len(nodes))
+
+		progress := func(p uint) {
+			state.UpdateProgress((uint(i)*100 + p) / uint(len(nodes)))
+		}
+		upload, err := Nodes.flashFirmware(state.Context, node, 'F', ihex, delta, progress)
+		if err != nil {
+			err = fmt.Errorf("Rollout of %s stopped at node %d, after updating %d of %d nodes: %s", image.Id(), node, i, len(nodes), err.Error())
+			state.Fail(err)
+			return err
+		}
+		udid := Nodes.SetFirmware(node, image.Id())
+		report.Nodes = append(report.Nodes, RolloutNodeResult{Node: node, Udid: udid, Report: upload})
+	}
+
+	result, err := json.Marshal(report)
+	if err != nil {
+		state.Fail(err)
+		return err
+	}
+	state.SetResult(result, "application/json")
+	state.UpdateProgress(100)
+	state.UpdateStatus(JobCompleted, nil)
+	return nil
+}
@@ -0,0 +1,168 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"pannetrat.com/nocan/clog"
+	"pannetrat.com/nocan/intelhex"
+)
+
+// firmwarePage is the part of an image that falls in a single SPM page of a
+// node. Pages are aligned on the page size of the node, and only hold the
+// bytes defined by the image.
+type firmwarePage struct {
+	Address uint32
+	Data    []byte
+}
+
+func splitPages(ihex *intelhex.IntelHex, pageSize uint32) []firmwarePage {
+	var pages []firmwarePage
+
+	for _, block := range ihex.Blocks {
+		address := block.Address
+		data := block.Data
+		for len(data) > 0 {
+			size := pageSize - address%pageSize
+			if size > uint32(len(data)) {
+				size = uint32(len(data))
+			}
+			pages = append(pages, firmwarePage{Address: address, Data: data[:size]})
+			address += size
+			data = data[size:]
+		}
+	}
+	return pages
+}
+
+// readPage reads length bytes of memory from a node in its bootloader.
+func readPage(port *Port, node Node, memtype byte, address uint32, length int) ([]byte, error) {
+	if err := setAddress(port, node, memtype, address); err != nil {
+		return nil, err
+	}
+	data := make([]byte, 0, length)
+	for pos := 0; pos < length; pos += 8 {
+		rlen := length - pos
+		if rlen > 8 {
+			rlen = 8
+		}
+		port.SendMessage(NewSystemMessage(node, NOCAN_SYS_BOOTLOADER_READ, uint8(rlen), nil))
+		response := port.WaitForMessage(NewSystemMessageFilter(node, NOCAN_SYS_BOOTLOADER_READ_ACK), DefaultTimeout())
+		if response == nil || response.Id.GetSysParam() != 0 || len(response.Data) != rlen {
+			return nil, fmt.Errorf("NOCAN_SYS_BOOTLOADER_READ failed for node %d at address=0x%x", node, address+uint32(pos))
+		}
+		data = append(data, response.Data...)
+	}
+	return data, nil
+}
+
+type PageDiff struct {
+	Address      uint32 `json:"address"`
+	Size         uint32 `json:"size"`
+	Changed      bool   `json:"changed"`
+	ChangedBytes uint32 `json:"changed_bytes,omitempty"`
+}
+
+// FirmwareDiff is the result of a comparison job: a map of the pages covered
+// by an image, telling which ones differ from the memory of the node.
+type FirmwareDiff struct {
+	Node         Node       `json:"node"`
+	Memory       string     `json:"memory"`
+	Mcu          string     `json:"mcu"`
+	PageSize     uint32     `json:"page_size"`
+	Bytes        uint32     `json:"bytes"`
+	ChangedPages int        `json:"changed_pages"`
+	ChangedBytes uint32     `json:"changed_bytes"`
+	Pages        []PageDiff `json:"pages"`
+}
+
+// CompareFirmware reads the pages of a node covered by an image and reports
+// which ones differ. The node must have been reserved with Reserve, see
+// JobModel.CreateNodeJob. The job result is a FirmwareDiff in JSON.
+func (nm *NodeModel) CompareFirmware(state *JobState, node Node, memtype byte, ihex *intelhex.IntelHex) error {
+	diff, err := nm.compareFirmware(state.Context, node, memtype, ihex, state.UpdateProgress)
+	if err != nil {
+		state.Fail(err)
+		return err
+	}
+
+	result, err := json.Marshal(diff)
+	if err != nil {
+		state.Fail(err)
+		return err
+	}
+	state.SetResult(result, "application/json")
+	state.UpdateProgress(100)
+	state.UpdateStatus(JobCompleted, nil)
+	return nil
+}
+
+func (nm *NodeModel) compareFirmware(ctx context.Context, node Node, memtype byte, ihex *intelhex.IntelHex, progress func(uint)) (*FirmwareDiff, error) {
+	if err := nm.ValidateImage(node, memtype, ihex); err != nil {
+		return nil, err
+	}
+	mcu := nm.Mcu(node)
+
+	diff := &FirmwareDiff{Node: node, Memory: MemoryName(memtype), Mcu: mcu.Name, PageSize: mcu.PageSize, Pages: make([]PageDiff, 0)}
+	pages := splitPages(ihex, mcu.PageSize)
+	for _, page := range pages {
+		diff.Bytes += uint32(len(page.Data))
+	}
+
+	release, err := nm.acquireInterface(ctx, node)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	port := nm.createNodePort("firmware-diff", node)
+	defer PortManager.DestroyPort(port)
+
+	port.SendMessage(NewSystemMessage(node, NOCAN_SYS_NODE_BOOT_REQUEST, 0x01, nil))
+	if port.WaitForMessage(NewSystemMessageFilter(node, NOCAN_SYS_NODE_BOOT_ACK), ExtendedTimeout()) == nil {
+		return nil, fmt.Errorf("NOCAN_SYS_NODE_BOOT_ACK failed for node %d", node)
+	}
+
+	var compared uint32
+	for _, page := range pages {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("Comparison with node %d was cancelled", node)
+			break
+		}
+		var current []byte
+		if current, err = readPage(port, node, memtype, page.Address, len(page.Data)); err != nil {
+			break
+		}
+		pd := PageDiff{Address: page.Address, Size: uint32(len(page.Data))}
+		for i := range current {
+			if current[i] != page.Data[i] {
+				pd.ChangedBytes++
+			}
+		}
+		if pd.ChangedBytes > 0 {
+			pd.Changed = true
+			diff.ChangedPages++
+			diff.ChangedBytes += pd.ChangedBytes
+		}
+		diff.Pages = append(diff.Pages, pd)
+		compared += pd.Size
+		progress(uint(compared * 100 / diff.Bytes))
+	}
+
+	// leave the bootloader in all cases, since nothing was written
+	leaveBootloader(port, node)
+
+	if err != nil {
+		return nil, err
+	}
+	clog.Info("Compared %d bytes with node %d: %d of %d pages differ (%d bytes)", diff.Bytes, node, diff.ChangedPages, len(diff.Pages), diff.ChangedBytes)
+	return diff, nil
+}
+
+// pageUnchanged tells whether a page of a node in its bootloader already
+// holds the expected data.
+func pageUnchanged(port *Port, node Node, memtype byte, page firmwarePage) bool {
+	current, err := readPage(port, node, memtype, page.Address, len(page.Data))
+	return err == nil && bytes.Equal(current, page.Data)
+}
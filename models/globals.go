@@ -2,8 +2,12 @@ package models
 
 var (
 	Channels    *ChannelModel     = NewChannelModel()
+	Events      *EventModel       = NewEventModel()
+	Firmware    *FirmwareModel    = NewFirmwareModel()
+	History     *HistoryModel     = NewHistoryModel()
 	Interfaces  *InterfaceModel   = NewInterfaceModel()
 	Jobs        *JobModel         = NewJobModel()
 	Nodes       *NodeModel        = NewNodeModel()
 	PortManager *PortManagerModel = NewPortManagerModel()
+	Users       *UserModel        = NewUserModel()
 )
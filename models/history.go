@@ -0,0 +1,351 @@
+package models
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"pannetrat.com/nocan/clog"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Updates are written to the history files every HISTORY_FLUSH_INTERVAL,
+	// so that channel updates do not wait for the disk.
+	HISTORY_FLUSH_INTERVAL = 1 * time.Second
+	// Age based retention is enforced every HISTORY_COMPACT_INTERVAL.
+	HISTORY_COMPACT_INTERVAL = 1 * time.Hour
+	// Updates are not recorded while this many are waiting to be written.
+	HISTORY_MAX_PENDING = 10000
+)
+
+type HistoryRecord struct {
+	Time time.Time
+	Node Node
+	Data []byte
+}
+
+// HistoryModel records every channel update in an append-only file per
+// channel. Each line of a file holds a timestamp, the source node and the
+// value in hexadecimal. Files are named after channel ids rather than names,
+// since ids are kept in channels.dat and do not change when a channel is
+// renamed. Updates are kept in memory until Run writes them.
+type HistoryModel struct {
+	Mutex        sync.Mutex // protects the pending records
+	Directory    string
+	MaxRecords   int           // per channel, 0 for no limit
+	MaxAge       time.Duration // 0 for no limit
+	files        sync.Mutex    // serializes file accesses, taken before Mutex
+	pending      map[Channel][]*HistoryRecord
+	pendingCount int
+	counts       map[Channel]int // records in each file, protected by files
+}
+
+func NewHistoryModel() *HistoryModel {
+	return &HistoryModel{pending: make(map[Channel][]*HistoryRecord), counts: make(map[Channel]int)}
+}
+
+// Open enables history recording in the given directory.
+func (hm *HistoryModel) Open(directory string, maxRecords int, maxAge time.Duration) error {
+	hm.files.Lock()
+	defer hm.files.Unlock()
+	hm.Mutex.Lock()
+	defer hm.Mutex.Unlock()
+
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return err
+	}
+	hm.Directory = directory
+	hm.MaxRecords = maxRecords
+	hm.MaxAge = maxAge
+	return nil
+}
+
+func (hm *HistoryModel) fileName(channel Channel) string {
+	return filepath.Join(hm.Directory, strconv.Itoa(int(channel))+".log")
+}
+
+func parseHistoryLine(line string) (*HistoryRecord, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, fmt.Errorf("expected 3 fields, got %d", len(fields))
+	}
+	ts, err := time.Parse(time.RFC3339Nano, fields[0])
+	if err != nil {
+		return nil, err
+	}
+	node, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	record := &HistoryRecord{Time: ts, Node: Node(node)}
+	if len(fields) == 3 {
+		if record.Data, err = hex.DecodeString(fields[2]); err != nil {
+			return nil, err
+		}
+	}
+	return record, nil
+}
+
+func (record *HistoryRecord) String() string {
+	return fmt.Sprintf("%s %d %s", record.Time.UTC().Format(time.RFC3339Nano), record.Node, hex.EncodeToString(record.Data))
+}
+
+func (hm *HistoryModel) readRecords(channel Channel) ([]*HistoryRecord, error) {
+	var records []*HistoryRecord
+
+	file, err := os.Open(hm.fileName(channel))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return records, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	line_count := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line_count++
+		record, err := parseHistoryLine(scanner.Text())
+		if err != nil {
+			clog.Warning("Skipping incorrect history record for channel %d on line %d: %s", channel, line_count, err.Error())
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// compact rewrites a history file, keeping only the records allowed by the
+// retention limits.
+func (hm *HistoryModel) compact(channel Channel) error {
+	records, err := hm.readRecords(channel)
+	if err != nil {
+		return err
+	}
+
+	if hm.MaxAge > 0 {
+		limit := time.Now().Add(-hm.MaxAge)
+		first := 0
+		for first < len(records) && records[first].Time.Before(limit) {
+			first++
+		}
+		records = records[first:]
+	}
+	if hm.MaxRecords > 0 && len(records) > hm.MaxRecords {
+		records = records[len(records)-hm.MaxRecords:]
+	}
+
+	filename := hm.fileName(channel)
+	file, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	for _, record := range records {
+		fmt.Fprintln(w, record.String())
+	}
+	if err = w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	hm.counts[channel] = len(records)
+	return os.Rename(filename+".tmp", filename)
+}
+
+// compactAll enforces age based retention on all history files, including
+// the ones of channels that are not updated anymore.
+func (hm *HistoryModel) compactAll() {
+	hm.files.Lock()
+	defer hm.files.Unlock()
+
+	if hm.Directory == "" || hm.MaxAge == 0 {
+		return
+	}
+	filenames, err := filepath.Glob(filepath.Join(hm.Directory, "*.log"))
+	if err != nil {
+		clog.Error("Failed to list history files: %s", err.Error())
+		return
+	}
+	for _, filename := range filenames {
+		id, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(filename), ".log"))
+		if err != nil {
+			continue
+		}
+		if err = hm.compact(Channel(id)); err != nil {
+			clog.Error("Failed to compact history of channel %d: %s", id, err.Error())
+		}
+	}
+}
+
+// write appends records to the history file of a channel.
+func (hm *HistoryModel) write(channel Channel, records []*HistoryRecord) error {
+	count, ok := hm.counts[channel]
+	if !ok {
+		existing, err := hm.readRecords(channel)
+		if err != nil {
+			return err
+		}
+		count = len(existing)
+	}
+
+	file, err := os.OpenFile(hm.fileName(channel), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	for _, record := range records {
+		fmt.Fprintln(w, record.String())
+	}
+	err = w.Flush()
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// the file may hold some of the records, so it is counted again later
+		delete(hm.counts, channel)
+		return err
+	}
+	hm.counts[channel] = count + len(records)
+
+	// allow some slack over the record limit, so that files are not rewritten on every update
+	if hm.MaxRecords > 0 && hm.counts[channel] > hm.MaxRecords+hm.MaxRecords/4 {
+		return hm.compact(channel)
+	}
+	return nil
+}
+
+// takePending removes the records waiting to be written for a channel, or
+// for all channels if all is true.
+func (hm *HistoryModel) takePending(channel Channel, all bool) map[Channel][]*HistoryRecord {
+	hm.Mutex.Lock()
+	defer hm.Mutex.Unlock()
+
+	pending := make(map[Channel][]*HistoryRecord)
+	if all {
+		pending, hm.pending = hm.pending, pending
+		hm.pendingCount = 0
+	} else if records, ok := hm.pending[channel]; ok {
+		pending[channel] = records
+		delete(hm.pending, channel)
+		hm.pendingCount -= len(records)
+	}
+	return pending
+}
+
+func (hm *HistoryModel) writePending(pending map[Channel][]*HistoryRecord) {
+	for channel, records := range pending {
+		if err := hm.write(channel, records); err != nil {
+			clog.Error("Failed to record history of channel %d: %s", channel, err.Error())
+		}
+	}
+}
+
+// Flush writes the updates waiting in memory to the history files.
+func (hm *HistoryModel) Flush() {
+	hm.files.Lock()
+	defer hm.files.Unlock()
+
+	hm.writePending(hm.takePending(0, true))
+}
+
+// Append records a channel update, which is written to disk by Run.
+func (hm *HistoryModel) Append(channel Channel, node Node, data []byte) error {
+	hm.Mutex.Lock()
+	defer hm.Mutex.Unlock()
+
+	if hm.Directory == "" {
+		return nil
+	}
+	if hm.pendingCount >= HISTORY_MAX_PENDING {
+		return fmt.Errorf("%d updates are already waiting to be written", hm.pendingCount)
+	}
+	record := &HistoryRecord{Time: time.Now(), Node: node, Data: append([]byte(nil), data...)}
+	hm.pending[channel] = append(hm.pending[channel], record)
+	hm.pendingCount++
+	return nil
+}
+
+// Remove deletes the history of a channel, so that a channel reusing its id
+// starts with an empty history.
+func (hm *HistoryModel) Remove(channel Channel) error {
+	hm.files.Lock()
+	defer hm.files.Unlock()
+
+	if hm.Directory == "" {
+		return nil
+	}
+	hm.takePending(channel, false)
+	delete(hm.counts, channel)
+	if err := os.Remove(hm.fileName(channel)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Run writes recorded updates to the history files and enforces age based
+// retention until ctx is cancelled. Updates still in memory are written
+// before it returns.
+func (hm *HistoryModel) Run(ctx context.Context) {
+	flush := time.NewTicker(HISTORY_FLUSH_INTERVAL)
+	defer flush.Stop()
+	compact := time.NewTicker(HISTORY_COMPACT_INTERVAL)
+	defer compact.Stop()
+
+	hm.compactAll()
+	for {
+		select {
+		case <-ctx.Done():
+			hm.Flush()
+			return
+		case <-flush.C:
+			hm.Flush()
+		case <-compact.C:
+			hm.Flush()
+			hm.compactAll()
+		}
+	}
+}
+
+// Query returns, in chronological order, the most recent records of a
+// channel within [from, to]. Zero times leave the range open, and a limit of
+// 0 returns all matching records.
+func (hm *HistoryModel) Query(channel Channel, from time.Time, to time.Time, limit int) ([]*HistoryRecord, error) {
+	hm.files.Lock()
+	defer hm.files.Unlock()
+
+	if hm.Directory == "" {
+		return nil, fmt.Errorf("Channel history is not enabled")
+	}
+
+	// the latest updates may not be written yet
+	hm.writePending(hm.takePending(channel, false))
+	records, err := hm.readRecords(channel)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := make([]*HistoryRecord, 0, len(records))
+	for _, record := range records {
+		if !from.IsZero() && record.Time.Before(from) {
+			continue
+		}
+		if !to.IsZero() && record.Time.After(to) {
+			continue
+		}
+		selected = append(selected, record)
+	}
+	if limit > 0 && len(selected) > limit {
+		selected = selected[len(selected)-limit:]
+	}
+	return selected, nil
+}
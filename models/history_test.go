@@ -0,0 +1,95 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fileRecords(t *testing.T, hm *HistoryModel, channel Channel) int {
+	t.Helper()
+	data, err := ioutil.ReadFile(hm.fileName(channel))
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(data), "\n")
+}
+
+func TestHistoryBuffering(t *testing.T) {
+	hm := NewHistoryModel()
+	if err := hm.Open(t.TempDir(), 4, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		hm.Append(1, 2, []byte{byte(i)})
+	}
+	if n := fileRecords(t, hm, 1); n != 0 {
+		t.Errorf("%d records were written before being flushed", n)
+	}
+	// queries include the records that are not written yet
+	records, err := hm.Query(1, time.Time{}, time.Time{}, 0)
+	if err != nil || len(records) != 3 || records[2].Data[0] != 2 || records[2].Node != 2 {
+		t.Fatalf("Unexpected records %v (%v)", records, err)
+	}
+
+	// the record limit is enforced once the file goes over it by a quarter
+	for i := 3; i < 6; i++ {
+		hm.Append(1, 2, []byte{byte(i)})
+	}
+	hm.Flush()
+	if n := fileRecords(t, hm, 1); n != 4 {
+		t.Errorf("History holds %d records, expected 4", n)
+	}
+	if records, _ = hm.Query(1, time.Time{}, time.Time{}, 1); len(records) != 1 || records[0].Data[0] != 5 {
+		t.Errorf("Unexpected last record %v", records)
+	}
+
+	hm.Append(1, 2, []byte{6})
+	if err := hm.Remove(1); err != nil {
+		t.Fatal(err)
+	}
+	hm.Flush()
+	if n := fileRecords(t, hm, 1); n != 0 {
+		t.Errorf("Removed history holds %d records", n)
+	}
+}
+
+func TestHistoryRetention(t *testing.T) {
+	hm := NewHistoryModel()
+	if err := hm.Open(t.TempDir(), 0, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// a channel that is not updated anymore still loses its old records
+	old := &HistoryRecord{Time: time.Now().Add(-2 * time.Hour), Node: 3, Data: []byte{1}}
+	recent := &HistoryRecord{Time: time.Now().Add(-time.Minute), Node: 3, Data: []byte{2}}
+	content := fmt.Sprintf("%s\n%s\n", old.String(), recent.String())
+	if err := ioutil.WriteFile(hm.fileName(7), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		hm.Run(ctx)
+		close(done)
+	}()
+	hm.Append(8, 3, []byte{3})
+	cancel()
+	<-done
+
+	if n := fileRecords(t, hm, 7); n != 1 {
+		t.Errorf("History of channel 7 holds %d records, expected 1", n)
+	}
+	if n := fileRecords(t, hm, 8); n != 1 {
+		t.Errorf("Record of channel 8 was not written when stopping")
+	}
+}
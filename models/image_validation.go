@@ -0,0 +1,86 @@
+package models
+
+import (
+	"fmt"
+	"pannetrat.com/nocan/intelhex"
+	"strings"
+)
+
+// ImageRange is a range of addresses of an image that cannot be written to a
+// node, with the reason why.
+type ImageRange struct {
+	Start  uint32 `json:"start"`
+	End    uint32 `json:"end"` // last address of the range
+	Reason string `json:"reason"`
+}
+
+func (r ImageRange) String() string {
+	return fmt.Sprintf("0x%x-0x%x (%s)", r.Start, r.End, r.Reason)
+}
+
+// ImageValidationError is returned when an image does not fit the memory map
+// of a node.
+type ImageValidationError struct {
+	Node   Node         `json:"node"`
+	Memory string       `json:"memory"`
+	Mcu    string       `json:"mcu"`
+	Limit  uint32       `json:"limit"` // bytes available to images
+	Ranges []ImageRange `json:"ranges"`
+}
+
+func (e *ImageValidationError) Error() string {
+	ranges := make([]string, len(e.Ranges))
+	for i, r := range e.Ranges {
+		ranges[i] = r.String()
+	}
+	return fmt.Sprintf("Firmware cannot be written to the %s of node %d (%s, %d bytes available): %s", e.Memory, e.Node, e.Mcu, e.Limit, strings.Join(ranges, ", "))
+}
+
+// addRange records the part of [start, end) that lies in [low, high).
+func (e *ImageValidationError) addRange(start uint32, end uint32, low uint32, high uint32, reason string) {
+	if start < low {
+		start = low
+	}
+	if end > high {
+		end = high
+	}
+	if start < end {
+		e.Ranges = append(e.Ranges, ImageRange{Start: start, End: end - 1, Reason: reason})
+	}
+}
+
+// ValidateImage checks an image against the memory map of a node, before any
+// bus traffic: flash images must stay within the application area, below
+// the bootloader, and eeprom images within the eeprom. Blocks must not
+// overlap. It returns an *ImageValidationError listing each offending range.
+func (nm *NodeModel) ValidateImage(node Node, memtype byte, ihex *intelhex.IntelHex) error {
+	mcu := nm.Mcu(node)
+	limit := mcu.MemorySize(memtype)
+	verr := &ImageValidationError{Node: node, Memory: MemoryName(memtype), Mcu: mcu.Name, Limit: limit}
+
+	var last *intelhex.IntelHexMemBlock
+	for _, block := range ihex.Blocks {
+		start, end := block.Address, block.End()
+		if end < start {
+			// the block wraps around the address space
+			verr.Ranges = append(verr.Ranges, ImageRange{Start: start, End: ^uint32(0), Reason: "beyond the end of the address space"})
+			continue
+		}
+		if last != nil && start < last.End() {
+			verr.addRange(start, end, start, last.End(), fmt.Sprintf("overlaps the block at 0x%x", last.Address))
+		}
+		if last == nil || end > last.End() {
+			last = block
+		}
+		if memtype == 'F' {
+			verr.addRange(start, end, limit, mcu.FlashSize, "bootloader area")
+			verr.addRange(start, end, mcu.FlashSize, ^uint32(0), "beyond the end of flash")
+		} else {
+			verr.addRange(start, end, limit, ^uint32(0), "beyond the end of eeprom")
+		}
+	}
+	if len(verr.Ranges) > 0 {
+		return verr
+	}
+	return nil
+}
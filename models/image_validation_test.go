@@ -0,0 +1,72 @@
+package models
+
+import (
+	"pannetrat.com/nocan/intelhex"
+	"reflect"
+	"testing"
+)
+
+func imageOf(blocks ...*intelhex.IntelHexMemBlock) *intelhex.IntelHex {
+	ihex := intelhex.New()
+	for _, block := range blocks {
+		ihex.Blocks = append(ihex.Blocks, block)
+		ihex.Size += uint(len(block.Data))
+	}
+	return ihex
+}
+
+func block(address uint32, size int) *intelhex.IntelHexMemBlock {
+	return &intelhex.IntelHexMemBlock{Type: 0, Address: address, Data: make([]byte, size)}
+}
+
+func TestValidateImage(t *testing.T) {
+	nm := &NodeModel{}
+	atmega644, _ := LookupMcu("1e960a")
+	nm.States[2] = &NodeState{Id: 2, Mcu: atmega644}
+
+	tests := []struct {
+		name    string
+		node    Node
+		memtype byte
+		image   *intelhex.IntelHex
+		ranges  []ImageRange
+	}{
+		{"application", 1, 'F', imageOf(block(0, 0x100), block(0x6F00, 0x100)), nil},
+		{"bootloader", 1, 'F', imageOf(block(0x6F00, 0x200)), []ImageRange{
+			{0x7000, 0x70FF, "bootloader area"},
+		}},
+		{"end of flash", 1, 'F', imageOf(block(0x7F00, 0x200)), []ImageRange{
+			{0x7F00, 0x7FFF, "bootloader area"},
+			{0x8000, 0x80FF, "beyond the end of flash"},
+		}},
+		{"overlap", 1, 'F', imageOf(block(0, 0x20), block(0x10, 0x20)), []ImageRange{
+			{0x10, 0x1F, "overlaps the block at 0x0"},
+		}},
+		{"eeprom", 1, 'E', imageOf(block(0x3F0, 0x20)), []ImageRange{
+			{0x400, 0x40F, "beyond the end of eeprom"},
+		}},
+		{"wrap around", 1, 'F', imageOf(block(0, 0x100), block(0xFFFFFF00, 0x200)), []ImageRange{
+			{0xFFFFFF00, 0xFFFFFFFF, "beyond the end of the address space"},
+		}},
+		{"identified node", 2, 'F', imageOf(block(0xE000, 0x1000)), nil},
+		{"identified node eeprom", 2, 'E', imageOf(block(0x400, 0x400)), nil},
+	}
+
+	for _, test := range tests {
+		err := nm.ValidateImage(test.node, test.memtype, test.image)
+		if test.ranges == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", test.name, err.Error())
+			}
+			continue
+		}
+		verr, ok := err.(*ImageValidationError)
+		if !ok {
+			t.Errorf("%s: expected an ImageValidationError, got %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(verr.Ranges, test.ranges) {
+			t.Errorf("%s: got ranges %v, expected %v", test.name, verr.Ranges, test.ranges)
+		}
+	}
+}
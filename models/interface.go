@@ -1,6 +1,7 @@
 package models
 
 import (
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -24,6 +25,7 @@ var (
 	InterfaceInputError        = errors.New("Interface input error")
 	InterfaceTimeoutError      = errors.New("Operation timed out")
 	InterfaceOperationError    = errors.New("Operation failed")
+	InterfaceUnsupportedError  = errors.New("Operation is not supported by this interface")
 )
 
 const (
@@ -46,10 +48,17 @@ const (
 	POWER_FLAGS_FAULT  = 4
 )
 
+// InterfaceOptions are settings applied to an interface when it is started.
+// Options left to nil keep the current setting of the interface.
+type InterfaceOptions struct {
+	PowerOn     *bool `json:"power_on,omitempty"`
+	Termination *bool `json:"termination,omitempty"`
+}
+
 type InterfaceState struct {
 	InterfaceId   int        `json:"id"`
 	Access        sync.Mutex `json:"-"`
-	Serial        *SerialCan `json:"-"`
+	Transport     Transport  `json:"-"`
 	DeviceName    string     `json:"device_name"`
 	InputResponse chan []byte
 	InputBuffer   [128]*Message `json:"-"`
@@ -62,11 +71,13 @@ type InterfaceState struct {
 		SenseLevel   float32 `json:"sense_level"`
 		UsbReference float32 `json:"usb_reference"`
 	} `json:"power_status"`
-	Connected bool `json:"connected"`
+	Connected bool             `json:"connected"`
+	Options   InterfaceOptions `json:"options"`
+	reconnect chan struct{}
 }
 
 func newInterface(deviceName string) (*InterfaceState, error) {
-	serial, err := SerialCanOpen(deviceName)
+	transport, err := OpenTransport(deviceName)
 	if err != nil {
 		clog.Error("Could not open %s: %s", deviceName, err.Error())
 		return nil, err
@@ -74,16 +85,42 @@ func newInterface(deviceName string) (*InterfaceState, error) {
 	//clog.Debug("Opened device %s", deviceName)
 
 	driver := &InterfaceState{
-		Serial:        serial,
+		Transport:     transport,
 		DeviceName:    deviceName,
 		Connected:     true,
-		InputResponse: make(chan []byte, 1)}
-
+		InputResponse: make(chan []byte, 1),
+		reconnect:     make(chan struct{}, 1)}
+
+	if rt, ok := transport.(ReconnectingTransport); ok {
+		rt.OnReconnect(func() {
+			// processMessages resets the interface between two commands
+			select {
+			case driver.reconnect <- struct{}{}:
+			default:
+			}
+		})
+	}
 	return driver, nil
 }
 
+// reconnected resets an interface whose transport restored its link by itself.
+func (ds *InterfaceState) reconnected() {
+	if err := ds.DoSoftReset(); err != nil {
+		clog.Warning("Failed to reset interface %s after reconnection: %s", ds.DeviceName, err.Error())
+		return
+	}
+	if err := ds.ApplyOptions(); err != nil {
+		clog.Warning(err.Error())
+	}
+}
+
+// doCommand sends a command to the interface and waits for its response.
+// Commands are sent one at a time, so that responses cannot be swapped.
 func (ds *InterfaceState) doCommand(query []byte) ([]byte, error) {
-	if _, err := ds.Serial.Write(query[:]); err != nil {
+	ds.Access.Lock()
+	defer ds.Access.Unlock()
+
+	if _, err := ds.Transport.Write(query[:]); err != nil {
 		return nil, err
 	}
 
@@ -95,6 +132,9 @@ func (ds *InterfaceState) doCommand(query []byte) ([]byte, error) {
 		if (result[0] & 0xF0) == SERIAL_HEADER_SUCCESS {
 			return result, nil
 		}
+		if result[0] == SERIAL_HEADER_COMMAND_UNKNOWN {
+			return nil, InterfaceUnsupportedError
+		}
 		if result[0] == SERIAL_HEADER_FAIL {
 			return nil, fmt.Errorf("Failed command: %s", hex.EncodeToString(query))
 		}
@@ -154,6 +194,44 @@ func (ds *InterfaceState) DoSetCanResistor(resOn byte) error {
 	return err
 }
 
+// SetOptions changes the options of a running interface and applies them.
+func (ds *InterfaceState) SetOptions(options InterfaceOptions) error {
+	ds.Access.Lock()
+	ds.Options = options
+	ds.Access.Unlock()
+
+	return ds.ApplyOptions()
+}
+
+// ApplyOptions sends the power and termination resistor settings of the
+// interface options.
+func (ds *InterfaceState) ApplyOptions() error {
+	// Access is only held while copying, since commands take it too
+	ds.Access.Lock()
+	options := ds.Options
+	ds.Access.Unlock()
+
+	if options.PowerOn != nil {
+		power := byte(INTERFACE_POWER_OFF)
+		if *options.PowerOn {
+			power = INTERFACE_POWER_ON
+		}
+		if err := ds.DoSetPower(power); err != nil {
+			return fmt.Errorf("Failed to set power of %s: %s", ds.DeviceName, err.Error())
+		}
+	}
+	if options.Termination != nil {
+		resistor := byte(INTERFACE_RESISTOR_OFF)
+		if *options.Termination {
+			resistor = INTERFACE_RESISTOR_ON
+		}
+		if err := ds.DoSetCanResistor(resistor); err != nil {
+			return fmt.Errorf("Failed to set termination resistor of %s: %s", ds.DeviceName, err.Error())
+		}
+	}
+	return nil
+}
+
 func (ds *InterfaceState) DoVersion() ([]byte, error) {
 	return ds.doCommand([]byte{SERIAL_HEADER_VERSION})
 }
@@ -169,9 +247,8 @@ func (ds *InterfaceState) Rescue() bool {
 	for {
 		close(ds.InputResponse)
 		ds.InputResponse = make(chan []byte, 1)
-		serial, err := SerialCanOpen(ds.DeviceName)
+		err := ds.Transport.Open()
 		if err == nil {
-			ds.Serial = serial
 			clog.Info("Reopened device %s", ds.DeviceName)
 			if err = ds.DoSoftReset(); err != nil {
 				clog.Warning(err.Error())
@@ -187,7 +264,7 @@ func (ds *InterfaceState) Rescue() bool {
 }
 
 func (ds *InterfaceState) Close() {
-	ds.Serial.Close()
+	ds.Transport.Close()
 }
 
 func (ds *InterfaceState) assemblePacket(packet []byte) error {
@@ -231,12 +308,16 @@ func (ds *InterfaceState) assemblePacket(packet []byte) error {
 	return nil
 }
 
-func (ds *InterfaceState) processInput() {
+func (ds *InterfaceState) processInput(ctx context.Context) {
 	for {
 		packet := make([]byte, 16)
-		_, err := ds.Serial.Read(packet)
+		_, err := ds.Transport.Read(packet)
+		if err != nil && ctx.Err() != nil {
+			// the interface was closed on shutdown
+			return
+		}
 		if err != nil {
-			clog.Error("Failed to read from serial interface: %s", err.Error())
+			clog.Error("Failed to read from interface %s: %s", ds.DeviceName, err.Error())
 			ds.Rescue()
 		} else {
 			if packet[0] == SERIAL_HEADER_PACKET {
@@ -254,14 +335,20 @@ func (ds *InterfaceState) processInput() {
 	}
 }
 
-func (ds *InterfaceState) processMessages() {
+func (ds *InterfaceState) processMessages(ctx context.Context) {
 	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
 
 	for {
 		var frame CanFrame
 
 		select {
+		case <-ctx.Done():
+			return
 		case m := <-ds.Port.Input:
+			if !Interfaces.routeMessage(ds, m) {
+				continue
+			}
 			pos := 0
 			for {
 				frame.CanId = (m.Id & CANID_MASK_MESSAGE) | CANID_MASK_EXTENDED
@@ -277,17 +364,19 @@ func (ds *InterfaceState) processMessages() {
 				copy(frame.CanData[:], m.Data[pos:pos+int(frame.CanDlc)])
 				clog.Debug("Sending CAN frame: %s:", frame.String())
 				if err := ds.DoFrame(&frame); err != nil {
-					clog.Error("Failed to send frame to %s: %s", ds.DeviceName, err.Error())
-					return
+					clog.Error("Failed to send frame to %s, dropping message: %s", ds.DeviceName, err.Error())
+					break
 				}
 				pos += int(frame.CanDlc)
 				if pos >= len(m.Data) {
 					break
 				}
 			}
+		case <-ds.reconnect:
+			ds.reconnected()
 		case <-ticker.C:
 			/*
-				if status, ok := ds.Serial.Status(); ok {
+				if status, ok := ds.Transport.Status(); ok {
 					clog.Debug("Serial status is %x", status)
 				} else {
 					clog.Error("Serial status failed")
@@ -324,15 +413,73 @@ func (dm *InterfaceModel) GetInterface(id int) *InterfaceState {
 	return dm.Interfaces[id]
 }
 
-func (dm *InterfaceModel) Run() {
+// ByPort returns the interface whose port has the given id, or nil if the
+// port does not belong to an interface.
+func (dm *InterfaceModel) ByPort(port PortId) *InterfaceState {
 	for _, driver := range dm.Interfaces {
-		go driver.processInput()
-		go driver.processMessages()
+		if driver.Port != nil && driver.Port.Id == port {
+			return driver
+		}
+	}
+	return nil
+}
+
+// ByDeviceName returns the interface opened with the given device name, or
+// nil if there is none.
+func (dm *InterfaceModel) ByDeviceName(name string) *InterfaceState {
+	for _, driver := range dm.Interfaces {
+		if driver.DeviceName == name {
+			return driver
+		}
+	}
+	return nil
+}
+
+// InterfaceIdOf returns the id of the interface a message came from, or -1
+// if it was not received from a bus.
+func (dm *InterfaceModel) InterfaceIdOf(m *Message) int {
+	if driver := dm.ByPort(m.SourcePort); driver != nil {
+		return driver.InterfaceId
+	}
+	return -1
+}
+
+// Run starts processing the traffic of all interfaces, until ctx is
+// cancelled.
+func (dm *InterfaceModel) Run(ctx context.Context) {
+	for _, driver := range dm.Interfaces {
+		go driver.processInput(ctx)
+		go driver.processMessages(ctx)
 
 		if err := driver.DoSoftReset(); err != nil {
+			if err == InterfaceDisconnectedError {
+				clog.Warning("Interface %s is not connected yet, skipping reset", driver.DeviceName)
+				continue
+			}
 			clog.Error(err.Error())
 			panic(err.Error())
 		}
+		if err := driver.ApplyOptions(); err != nil {
+			clog.Warning(err.Error())
+		}
+	}
+}
+
+// PowerOff turns off the power supplied to the bus by all interfaces.
+func (dm *InterfaceModel) PowerOff() {
+	for _, driver := range dm.Interfaces {
+		if err := driver.DoSetPower(INTERFACE_POWER_OFF); err != nil {
+			clog.Warning("Failed to power off %s: %s", driver.DeviceName, err.Error())
+		} else {
+			clog.Info("Powered off %s", driver.DeviceName)
+		}
+	}
+}
+
+// Close closes all interfaces, once Run has been stopped.
+func (dm *InterfaceModel) Close() {
+	for _, driver := range dm.Interfaces {
+		driver.Close()
 	}
 }
 
@@ -1,8 +1,10 @@
 package models
 
 import (
-	//"io"
+	"context"
+	"fmt"
 	"pannetrat.com/nocan/clog"
+	"sort"
 	"sync"
 	"time"
 )
@@ -11,19 +13,44 @@ const (
 	JobStarted   = 1
 	JobCompleted = 2
 	JobFailed    = 3
+	JobCancelled = 4
 )
 
+const JOB_EXPIRE_INTERVAL = 10 * time.Second
+
+func JobStatusName(status uint) string {
+	switch status {
+	case JobStarted:
+		return "started"
+	case JobCompleted:
+		return "completed"
+	case JobFailed:
+		return "failed"
+	case JobCancelled:
+		return "cancelled"
+	}
+	return "unknown"
+}
+
 type JobState struct {
 	Mutex         sync.RWMutex
 	Id            uint
+	Type          string // the operation performed, e.g. "flash upload"
+	Nodes         []Node
 	Result        []byte
+	ResultType    string // MIME type of Result, Intel HEX if empty
 	Status        uint
 	Progress      uint
 	FailureReason error
+	CreatedAt     time.Time
+	FinishedAt    time.Time
+	Context       context.Context // cancelled by JobModel.CancelJob
+	cancel        context.CancelFunc
 }
 
 func NewJob(id uint) *JobState {
-	return &JobState{Id: id, Status: JobStarted, Progress: 0}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &JobState{Id: id, Status: JobStarted, Progress: 0, CreatedAt: time.Now(), Context: ctx, cancel: cancel}
 }
 
 func (job *JobState) GetStatus() uint {
@@ -36,6 +63,9 @@ func (job *JobState) UpdateStatus(status uint, failureReason error) {
 	job.Mutex.Lock()
 	job.Status = status
 	job.FailureReason = failureReason
+	if status != JobStarted {
+		job.FinishedAt = time.Now()
+	}
 	job.Mutex.Unlock()
 }
 
@@ -51,46 +81,210 @@ func (job *JobState) UpdateProgress(progress uint) {
 	job.Mutex.Unlock()
 }
 
+// SetResult stores the result of a job, in Intel HEX if resultType is empty.
+func (job *JobState) SetResult(result []byte, resultType string) {
+	job.Mutex.Lock()
+	job.Result = result
+	job.ResultType = resultType
+	job.Mutex.Unlock()
+}
+
+func (job *JobState) GetResult() ([]byte, string) {
+	job.Mutex.RLock()
+	defer job.Mutex.RUnlock()
+	return job.Result, job.ResultType
+}
+
+// Cancelled returns an error if the job was cancelled. Long operations call
+// it between steps, and stop with the error.
+func (job *JobState) Cancelled() error {
+	if job.Context.Err() != nil {
+		return fmt.Errorf("Job %d was cancelled", job.Id)
+	}
+	return nil
+}
+
+// Fail settles a job that could not complete, as cancelled if it was
+// cancelled, or as failed otherwise.
+func (job *JobState) Fail(err error) {
+	if job.Context.Err() != nil {
+		job.UpdateStatus(JobCancelled, err)
+	} else {
+		job.UpdateStatus(JobFailed, err)
+	}
+}
+
+type JobInfo struct {
+	Id         uint       `json:"id"`
+	Type       string     `json:"type"`
+	Nodes      []Node     `json:"nodes,omitempty"`
+	Status     string     `json:"status"`
+	Progress   uint       `json:"progress"`
+	Error      string     `json:"error,omitempty"`
+	HasResult  bool       `json:"has_result"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+func (job *JobState) Info() JobInfo {
+	job.Mutex.RLock()
+	defer job.Mutex.RUnlock()
+
+	info := JobInfo{
+		Id:        job.Id,
+		Type:      job.Type,
+		Nodes:     job.Nodes,
+		Status:    JobStatusName(job.Status),
+		Progress:  job.Progress,
+		HasResult: job.Result != nil,
+		CreatedAt: job.CreatedAt,
+	}
+	if job.FailureReason != nil {
+		info.Error = job.FailureReason.Error()
+	}
+	if !job.FinishedAt.IsZero() {
+		finished := job.FinishedAt
+		info.FinishedAt = &finished
+	}
+	return info
+}
+
 type JobModel struct {
-	Mutex   sync.RWMutex
-	NextId  uint
-	Jobs    map[uint]*JobState
-	Expired chan uint
+	Mutex     sync.RWMutex
+	NextId    uint
+	Jobs      map[uint]*JobState
+	Retention time.Duration // how long finished jobs are kept, 0 to keep them until deleted
+	running   sync.WaitGroup
 }
 
 func NewJobModel() *JobModel {
-	return &JobModel{NextId: 0, Jobs: make(map[uint]*JobState)}
+	return &JobModel{NextId: 0, Jobs: make(map[uint]*JobState), Retention: 10 * time.Minute}
 }
 
-func (jm *JobModel) CreateJob(fn func(*JobState)) uint {
+// CreateJob starts a job running fn. If fn returns without settling the
+// job, or panics, the job is marked as failed.
+func (jm *JobModel) CreateJob(operation string, nodes []Node, fn func(*JobState)) uint {
 	jm.Mutex.Lock()
 
 	jobid := jm.NextId
 	job := NewJob(jobid)
+	job.Type = operation
+	job.Nodes = nodes
 	jm.Jobs[jobid] = job
 	jm.NextId++
 
 	jm.Mutex.Unlock()
 
-	clog.Debug("Started job %d", jobid)
+	clog.Debug("Started job %d (%s)", jobid, operation)
 
+	jm.running.Add(1)
 	go func() {
+		defer jm.running.Done()
+		defer job.cancel()
+		defer func() {
+			if r := recover(); r != nil {
+				clog.Error("Job %d (%s) panicked: %v", jobid, operation, r)
+				job.Fail(fmt.Errorf("Job %d failed unexpectedly: %v", jobid, r))
+			} else if job.GetStatus() == JobStarted {
+				job.Fail(fmt.Errorf("Job %d ended without reporting a result", jobid))
+			}
+		}()
 		fn(job)
-		time.Sleep(time.Second * 60)
-		if jm.FinalizeJob(jobid) {
-			clog.Warning("Results of job %d were removed after remaining unaccessed for 60 seconds", jobid)
-		}
 	}()
 
 	return jobid
 }
 
+// CreateNodeJob reserves nodes for an operation and starts a job, releasing
+// the nodes when fn returns. It fails with a NodeBusyError if one of the nodes
+// is already reserved.
+func (jm *JobModel) CreateNodeJob(operation string, nodes []Node, fn func(*JobState)) (uint, error) {
+	if err := Nodes.Reserve(operation, nodes...); err != nil {
+		return 0, err
+	}
+	return jm.CreateJob(operation, nodes, func(state *JobState) {
+		defer Nodes.Release(nodes...)
+		fn(state)
+	}), nil
+}
+
 func (jm *JobModel) FindJob(job uint) *JobState {
 	jm.Mutex.RLock()
 	defer jm.Mutex.RUnlock()
 	return jm.Jobs[job]
 }
 
+// List returns all jobs, oldest first.
+func (jm *JobModel) List() []JobInfo {
+	jm.Mutex.RLock()
+	defer jm.Mutex.RUnlock()
+
+	jobs := make([]JobInfo, 0, len(jm.Jobs))
+	for _, job := range jm.Jobs {
+		jobs = append(jobs, job.Info())
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Id < jobs[j].Id })
+	return jobs
+}
+
+// CancelJob asks a running job to stop. It returns false if the job does not
+// exist or has already finished.
+func (jm *JobModel) CancelJob(id uint) bool {
+	job := jm.FindJob(id)
+	if job == nil || job.GetStatus() != JobStarted {
+		return false
+	}
+	clog.Info("Cancelling job %d (%s)", id, job.Type)
+	job.cancel()
+	return true
+}
+
+// Drain waits for running jobs to finish. Jobs still running after timeout are
+// cancelled, and stop at the next safe point, such as the end of the page
+// being written. It returns false if some jobs did not stop.
+func (jm *JobModel) Drain(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		jm.running.Wait()
+		close(done)
+	}()
+
+	running := 0
+	jm.Mutex.RLock()
+	for _, job := range jm.Jobs {
+		if job.GetStatus() == JobStarted {
+			running++
+		}
+	}
+	jm.Mutex.RUnlock()
+	if running > 0 {
+		clog.Info("Waiting up to %s for %d running jobs to finish", timeout, running)
+	}
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+	}
+
+	jm.Mutex.RLock()
+	for id, job := range jm.Jobs {
+		if job.GetStatus() == JobStarted {
+			clog.Warning("Cancelling job %d (%s) on shutdown", id, job.Type)
+			job.cancel()
+		}
+	}
+	jm.Mutex.RUnlock()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(ExtendedTimeout()):
+		clog.Error("Some jobs did not stop after being cancelled")
+		return false
+	}
+}
+
 func (jm *JobModel) FinalizeJob(job uint) bool {
 	jm.Mutex.Lock()
 	defer jm.Mutex.Unlock()
@@ -103,6 +297,33 @@ func (jm *JobModel) FinalizeJob(job uint) bool {
 	return true
 }
 
-func (jm *JobModel) Run() {
-	/* do nothing */
+// Run removes finished jobs once they are older than Retention, until ctx is
+// cancelled.
+func (jm *JobModel) Run(ctx context.Context) {
+	ticker := time.NewTicker(JOB_EXPIRE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+
+		select {
+		case now = <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if jm.Retention <= 0 {
+			continue
+		}
+		jm.Mutex.Lock()
+		for id, job := range jm.Jobs {
+			job.Mutex.RLock()
+			expired := job.Status != JobStarted && now.Sub(job.FinishedAt) >= jm.Retention
+			job.Mutex.RUnlock()
+			if expired {
+				clog.Debug("Results of job %d were removed after %s", id, jm.Retention)
+				delete(jm.Jobs, id)
+			}
+		}
+		jm.Mutex.Unlock()
+	}
 }
@@ -0,0 +1,131 @@
+package models
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"pannetrat.com/nocan/clog"
+)
+
+// McuInfo describes the memory layout of a node microcontroller, as
+// identified by the signature returned by its bootloader.
+type McuInfo struct {
+	Name           string `json:"name"`
+	Signature      string `json:"signature"`
+	FlashSize      uint32 `json:"flash_size"`
+	PageSize       uint32 `json:"page_size"`
+	EepromSize     uint32 `json:"eeprom_size"`
+	BootloaderSize uint32 `json:"bootloader_size"` // reserved at the end of flash
+}
+
+// The NoCAN bootloader occupies the last 4K of flash on all supported parts.
+var McuTable = []McuInfo{
+	{Name: "ATmega328P", Signature: "1e950f", FlashSize: 0x8000, PageSize: 128, EepromSize: 0x400, BootloaderSize: 0x1000},
+	{Name: "ATmega328", Signature: "1e9514", FlashSize: 0x8000, PageSize: 128, EepromSize: 0x400, BootloaderSize: 0x1000},
+	{Name: "ATmega328PB", Signature: "1e9516", FlashSize: 0x8000, PageSize: 128, EepromSize: 0x400, BootloaderSize: 0x1000},
+	{Name: "ATmega32U4", Signature: "1e9587", FlashSize: 0x8000, PageSize: 128, EepromSize: 0x400, BootloaderSize: 0x1000},
+	{Name: "ATmega644P", Signature: "1e960a", FlashSize: 0x10000, PageSize: 256, EepromSize: 0x800, BootloaderSize: 0x1000},
+	{Name: "ATmega1284P", Signature: "1e9705", FlashSize: 0x20000, PageSize: 256, EepromSize: 0x1000, BootloaderSize: 0x1000},
+	{Name: "ATmega2560", Signature: "1e9801", FlashSize: 0x40000, PageSize: 256, EepromSize: 0x1000, BootloaderSize: 0x1000},
+}
+
+// DefaultMcu is assumed for nodes that have not been identified.
+var DefaultMcu = McuTable[0]
+
+func LookupMcu(signature string) (*McuInfo, bool) {
+	for i := range McuTable {
+		if McuTable[i].Signature == signature {
+			return &McuTable[i], true
+		}
+	}
+	return nil, false
+}
+
+// MemorySize returns the size of the memory that can be written by
+// firmware updates, either flash ('F') or eeprom ('E').
+func (mcu *McuInfo) MemorySize(memtype byte) uint32 {
+	if memtype == 'E' {
+		return mcu.EepromSize
+	}
+	return mcu.FlashSize - mcu.BootloaderSize
+}
+
+// MemoryName returns the name of a memory type, either flash ('F') or eeprom
+// ('E').
+func MemoryName(memtype byte) string {
+	if memtype == 'E' {
+		return "eeprom"
+	}
+	return "flash"
+}
+
+// Mcu returns the microcontroller of a node, or DefaultMcu if the node has
+// not been identified.
+func (nm *NodeModel) Mcu(node Node) *McuInfo {
+	nm.Mutex.RLock()
+	defer nm.Mutex.RUnlock()
+
+	if node >= 0 && nm.States[node] != nil && nm.States[node].Mcu != nil {
+		return nm.States[node].Mcu
+	}
+	return &DefaultMcu
+}
+
+// DoIdentify enters the bootloader of a node, reads its signature and leaves
+// the bootloader. The signature and the matching microcontroller are stored
+// with the node. It fails with a NodeBusyError if the node is reserved.
+func (nm *NodeModel) DoIdentify(node Node) (*McuInfo, error) {
+	if err := nm.Reserve("identification", node); err != nil {
+		return nil, err
+	}
+	defer nm.Release(node)
+
+	release, err := nm.acquireInterface(context.Background(), node)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	port := nm.createNodePort("identify", node)
+	defer PortManager.DestroyPort(port)
+
+	port.SendMessage(NewSystemMessage(node, NOCAN_SYS_NODE_BOOT_REQUEST, 0x01, nil))
+	if port.WaitForMessage(NewSystemMessageFilter(node, NOCAN_SYS_NODE_BOOT_ACK), ExtendedTimeout()) == nil {
+		return nil, fmt.Errorf("NOCAN_SYS_NODE_BOOT_ACK failed for node %d", node)
+	}
+
+	port.SendMessage(NewSystemMessage(node, NOCAN_SYS_BOOTLOADER_GET_SIGNATURE, 0, nil))
+	response := port.WaitForMessage(NewSystemMessageFilter(node, NOCAN_SYS_BOOTLOADER_GET_SIGNATURE_ACK), DefaultTimeout())
+
+	// leave the bootloader even if the signature could not be read
+	port.SendMessage(NewSystemMessage(node, NOCAN_SYS_BOOTLOADER_LEAVE, 0, nil))
+	if port.WaitForMessage(NewSystemMessageFilter(node, NOCAN_SYS_BOOTLOADER_LEAVE_ACK), DefaultTimeout()) == nil {
+		clog.Warning("NOCAN_SYS_BOOTLOADER_LEAVE failed for node %d", node)
+	} else if !waitForRejoin(port, node) {
+		clog.Warning("Node %d did not get its address back after leaving the bootloader", node)
+	}
+
+	if response == nil {
+		return nil, fmt.Errorf("NOCAN_SYS_BOOTLOADER_GET_SIGNATURE failed for node %d", node)
+	}
+	signature := hex.EncodeToString(response.Data)
+	if len(signature) > 6 {
+		// AVR signatures are 3 bytes long
+		signature = signature[:6]
+	}
+	mcu, ok := LookupMcu(signature)
+
+	nm.Mutex.Lock()
+	if ns := nm.States[node]; ns != nil {
+		ns.Signature = signature
+		ns.Mcu = mcu
+	}
+	nm.Mutex.Unlock()
+	nm.saveChanges()
+
+	if !ok {
+		return nil, fmt.Errorf("Node %d has an unknown signature %s", node, signature)
+	}
+	clog.Info("Node %d identified as %s (signature %s)", node, mcu.Name, signature)
+	return mcu, nil
+}
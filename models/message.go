@@ -50,6 +50,19 @@ func (m *Message) String() string {
 	return s + "]}"
 }
 
+// DataToText renders data as ASCII, replacing non printable characters with '.'.
+func DataToText(data []byte) string {
+	text := make([]byte, len(data))
+	for i, c := range data {
+		if c >= 32 && c < 127 {
+			text[i] = c
+		} else {
+			text[i] = '.'
+		}
+	}
+	return string(text)
+}
+
 func (m *Message) AppendData(data []byte) bool {
 	if len(m.Data)+len(data) > 64 {
 		return false
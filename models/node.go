@@ -2,6 +2,7 @@ package models
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -10,14 +11,16 @@ import (
 	"pannetrat.com/nocan/clog"
 	"pannetrat.com/nocan/intelhex"
 	"strconv"
+	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 	"unicode/utf8"
 )
 
 type Node int8
 
+var NodeNotFoundError = errors.New("Node does not exist")
+
 type NodeAttributes map[string]interface{}
 
 type NodeState struct {
@@ -25,10 +28,32 @@ type NodeState struct {
 	Id            Node             `json:"id"`
 	Udid          string           `json:"udid"`
 	LastSeen      time.Time        `json:"last_seen"`
+	Status        NodeStatus       `json:"status"`
+	Signature     string           `json:"signature,omitempty"`
+	Mcu           *McuInfo         `json:"mcu,omitempty"`
+	Firmware      string           `json:"firmware,omitempty"` // name@version of the last image flashed from the repository
+	InterfaceId   int              `json:"interface"`
 	Subscriptions map[Channel]bool `json:"-"`
 	Attributes    NodeAttributes   `json:"attributes"`
 }
 
+// clone copies a node state along with its maps, so that it can be used once
+// the NodeModel mutex is released.
+func (ns *NodeState) clone() *NodeState {
+	c := *ns
+	c.Subscriptions = make(map[Channel]bool, len(ns.Subscriptions))
+	for k, v := range ns.Subscriptions {
+		c.Subscriptions[k] = v
+	}
+	if ns.Attributes != nil {
+		c.Attributes = make(NodeAttributes, len(ns.Attributes))
+		for k, v := range ns.Attributes {
+			c.Attributes[k] = v
+		}
+	}
+	return &c
+}
+
 func (ns *NodeState) getStringAttribute(key string) (string, bool) {
 	if val, ok := ns.Attributes[key]; ok {
 		switch v := val.(type) {
@@ -75,21 +100,44 @@ func StringToUdid(s string, id []byte) error {
 }
 
 type NodeModel struct {
-	Mutex      sync.RWMutex
-	States     [128]*NodeState
-	Udids      map[string]Node
-	NodeFile   string
-	Inprogress int32
-	Port       *Port
+	Mutex        sync.RWMutex
+	States       [128]*NodeState
+	Udids        map[string]Node
+	NodeFile     string
+	Port         *Port
+	PingInterval time.Duration // 0 disables liveness monitoring
+	SuspectAfter time.Duration
+	OfflineAfter time.Duration
+	Policy       AllocationPolicy
+	Pending      map[string]*PendingNode
+	// Busy nodes and interface slots are protected by BusyMutex, see node_lock.go
+	BusyMutex                sync.Mutex
+	Busy                     map[Node]string
+	InterfaceSlots           map[int]chan struct{}
+	FirmwareJobsPerInterface int
 }
 
 func NewNodeModel() *NodeModel {
-	return &NodeModel{Udids: make(map[string]Node), Port: PortManager.CreatePort("nodes")}
+	return &NodeModel{
+		Udids:        make(map[string]Node),
+		Port:         PortManager.CreatePort("nodes"),
+		PingInterval: 30 * time.Second,
+		SuspectAfter: 60 * time.Second,
+		OfflineAfter: 120 * time.Second,
+		Policy:       AllocationPolicy{Mode: ALLOCATION_MODE_OPEN, Pins: make(map[string]Node)},
+		Pending:      make(map[string]*PendingNode),
+
+		Busy:                     make(map[Node]string),
+		InterfaceSlots:           make(map[int]chan struct{}),
+		FirmwareJobsPerInterface: 1,
+	}
 }
 
 type NodeInfo struct {
 	Node       Node           `json:"node"`
 	Attributes NodeAttributes `json:"attributes"`
+	Signature  string         `json:"signature,omitempty"`
+	Firmware   string         `json:"firmware,omitempty"`
 }
 
 func (nm *NodeModel) LoadFromFile(nodefile string) error {
@@ -114,7 +162,10 @@ func (nm *NodeModel) LoadFromFile(nodefile string) error {
 			clog.Warning("Node %d appears twice in %s, second instance will be ignored", v.Node, nodefile)
 		} else {
 			clog.Debug("Pre-registering %s as node %d", k, v.Node)
-			nm.States[v.Node] = &NodeState{Active: false, Id: v.Node, Udid: k, Attributes: v.Attributes, Subscriptions: make(map[Channel]bool)}
+			nm.States[v.Node] = &NodeState{Active: false, Id: v.Node, Udid: k, InterfaceId: -1, Attributes: v.Attributes, Signature: v.Signature, Firmware: v.Firmware, Subscriptions: make(map[Channel]bool)}
+			if v.Signature != "" {
+				nm.States[v.Node].Mcu, _ = LookupMcu(v.Signature)
+			}
 			nm.Udids[k] = v.Node
 		}
 	}
@@ -127,15 +178,113 @@ func (nm *NodeModel) SaveToFile() error {
 	nm.Mutex.RLock()
 	defer nm.Mutex.RUnlock()
 
+	if nm.NodeFile == "" {
+		return nil
+	}
+
 	for k, v := range nm.Udids {
-		info[k] = NodeInfo{Node: v, Attributes: nm.States[v].Attributes}
+		info[k] = NodeInfo{Node: v, Attributes: nm.States[v].Attributes, Signature: nm.States[v].Signature, Firmware: nm.States[v].Firmware}
 	}
 
 	js, err := json.MarshalIndent(info, "", "  ")
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(nm.NodeFile, js, 0644)
+	return writeFileAtomic(nm.NodeFile, js, 0644)
+}
+
+// ValidateAttribute checks that an attribute can be used in channel name
+// expansion: values must be strings, numbers or booleans.
+func ValidateAttribute(key string, value interface{}) error {
+	if key == "" || len(key) > 64 {
+		return fmt.Errorf("Attribute names must be between 1 and 64 characters long")
+	}
+	if strings.ContainsAny(key, "${}") {
+		return fmt.Errorf("Attribute name '%s' cannot contain '$', '{' or '}'", key)
+	}
+	switch value.(type) {
+	case string, float64, bool:
+		return nil
+	}
+	return fmt.Errorf("Attribute '%s' must be a string, a number or a boolean", key)
+}
+
+// UpdateAttributes replaces the attributes of a node or, if merge is true,
+// applies them as a JSON merge patch, where nil values remove attributes.
+// It returns the resulting attributes.
+func (nm *NodeModel) UpdateAttributes(node Node, attributes NodeAttributes, merge bool) (NodeAttributes, error) {
+	for k, v := range attributes {
+		if v == nil && merge {
+			continue
+		}
+		if err := ValidateAttribute(k, v); err != nil {
+			return nil, err
+		}
+	}
+
+	nm.Mutex.Lock()
+	if node < 0 || nm.States[node] == nil {
+		nm.Mutex.Unlock()
+		return nil, NodeNotFoundError
+	}
+	ns := nm.States[node]
+
+	updated := make(NodeAttributes)
+	if merge {
+		for k, v := range ns.Attributes {
+			updated[k] = v
+		}
+	}
+	for k, v := range attributes {
+		if v == nil {
+			delete(updated, k)
+		} else {
+			updated[k] = v
+		}
+	}
+	ns.Attributes = updated
+
+	result := make(NodeAttributes)
+	for k, v := range updated {
+		result[k] = v
+	}
+	nm.Mutex.Unlock()
+
+	nm.saveChanges()
+	return result, nil
+}
+
+// SetFirmware records the firmware running on a node and returns its UDID.
+func (nm *NodeModel) SetFirmware(node Node, firmware string) string {
+	var udid string
+
+	nm.Mutex.Lock()
+	if node >= 0 && nm.States[node] != nil {
+		nm.States[node].Firmware = firmware
+		udid = nm.States[node].Udid
+	}
+	nm.Mutex.Unlock()
+
+	nm.saveChanges()
+	return udid
+}
+
+// Select returns the nodes on the bus that have an attribute with the given
+// value, in increasing order.
+func (nm *NodeModel) Select(key string, value string) []Node {
+	var nodes []Node
+
+	nm.Mutex.RLock()
+	defer nm.Mutex.RUnlock()
+
+	for i := 1; i < 128; i++ {
+		if ns := nm.getState(Node(i)); ns != nil {
+			if v, ok := ns.getStringAttribute(key); ok && v == value {
+				nodes = append(nodes, Node(i))
+			}
+		}
+	}
+	return nodes
 }
 
 func (nm *NodeModel) ExpandKeywords(node Node, str string) (string, bool) {
@@ -205,7 +354,10 @@ func (nm *NodeModel) Lookup(node []byte) (Node, bool) {
 	return Node(-1), false
 }
 
-func (nm *NodeModel) Register(node []byte) (Node, error) {
+// Register allocates a node id for the given UDID, according to the
+// allocation policy, and records the interface the node is connected to (-1
+// if unknown).
+func (nm *NodeModel) Register(node []byte, interfaceId int) (Node, error) {
 	if len(node) != 8 {
 		return Node(-1), errors.New("Node identifier must be 8 bytes long")
 	}
@@ -216,24 +368,31 @@ func (nm *NodeModel) Register(node []byte) (Node, error) {
 
 	if n, ok := nm.Udids[udid]; ok {
 		nm.States[n].Active = true
+		nm.States[n].InterfaceId = interfaceId
+		nm.States[n].LastSeen = time.Now()
+		event := nm.States[n].setStatus(NODE_STATUS_ONLINE)
 		nm.Mutex.Unlock()
+		emitNodeStatus(event)
 		return n, nil
 	}
 
-	for i := 1; i < 128; i++ {
-		if nm.States[i] == nil {
-			nm.States[i] = &NodeState{Active: true, Udid: udid, Id: Node(i), Subscriptions: make(map[Channel]bool)}
-			nm.Udids[udid] = Node(i)
-			nm.Mutex.Unlock()
-			if err := nm.SaveToFile(); err != nil {
-				clog.Warning("Failed to save node info: %s", err.Error())
-			}
-			return Node(i), nil
-		}
+	if err := nm.admit(udid, interfaceId); err != nil {
+		nm.Mutex.Unlock()
+		return Node(-1), err
 	}
 
+	i, err := nm.allocate(udid)
+	if err != nil {
+		nm.Mutex.Unlock()
+		return Node(-1), err
+	}
+	nm.States[i] = &NodeState{Active: true, Udid: udid, Id: i, InterfaceId: interfaceId, LastSeen: time.Now(), Subscriptions: make(map[Channel]bool)}
+	nm.Udids[udid] = i
+	event := nm.States[i].setStatus(NODE_STATUS_ONLINE)
 	nm.Mutex.Unlock()
-	return Node(-1), errors.New("Maximum number of nodes has been reached.")
+	emitNodeStatus(event)
+	nm.saveChanges()
+	return i, nil
 }
 
 func (nm *NodeModel) Unregister(node Node) bool {
@@ -249,6 +408,94 @@ func (nm *NodeModel) Unregister(node Node) bool {
 	return true
 }
 
+func (nm *NodeModel) saveChanges() {
+	if err := nm.SaveToFile(); err != nil {
+		clog.Warning("Failed to save node info: %s", err.Error())
+	}
+}
+
+// requestReaddressing reboots a node that is present on the bus, so that it
+// requests an address again.
+func (nm *NodeModel) requestReaddressing(node Node) {
+	clog.Info("Rebooting node %d so that it requests a new address", node)
+	// param 0 reboots straight into the application, without staying in the bootloader
+	nm.Port.SendMessage(NewSystemMessage(node, NOCAN_SYS_NODE_BOOT_REQUEST, 0x00, nil))
+}
+
+// Decommission forgets a node, whether it is currently on the bus or only
+// known from the node file, and frees its id.
+func (nm *NodeModel) Decommission(node Node) error {
+	if node <= 0 {
+		return fmt.Errorf("Node %d cannot be decommissioned", node)
+	}
+	if operation, busy := nm.BusyWith(node); busy {
+		return &NodeBusyError{Node: node, Operation: operation}
+	}
+
+	nm.Mutex.Lock()
+	ns := nm.States[node]
+	if ns == nil {
+		nm.Mutex.Unlock()
+		return NodeNotFoundError
+	}
+	delete(nm.Udids, ns.Udid)
+	nm.States[node] = nil
+	nm.Mutex.Unlock()
+
+	clog.Info("Decommissioned node %d (%s)", node, ns.Udid)
+	nm.saveChanges()
+	if ns.Active {
+		nm.requestReaddressing(node)
+	}
+	return nil
+}
+
+// Reassign moves the UDID of a node to a different, unused, node id.
+func (nm *NodeModel) Reassign(node Node, newNode Node) error {
+	if node <= 0 || newNode <= 0 {
+		return fmt.Errorf("Node ids must be between 1 and 127")
+	}
+	if operation, busy := nm.BusyWith(node); busy {
+		return &NodeBusyError{Node: node, Operation: operation}
+	}
+
+	nm.Mutex.Lock()
+	ns := nm.States[node]
+	if ns == nil {
+		nm.Mutex.Unlock()
+		return NodeNotFoundError
+	}
+	if node == newNode {
+		nm.Mutex.Unlock()
+		return nil
+	}
+	if nm.States[newNode] != nil {
+		nm.Mutex.Unlock()
+		return fmt.Errorf("Node %d is already assigned to %s", newNode, nm.States[newNode].Udid)
+	}
+	nm.States[node] = nil
+	nm.States[newNode] = &NodeState{
+		Active:        false, // until the node requests its new address
+		Id:            newNode,
+		Udid:          ns.Udid,
+		InterfaceId:   ns.InterfaceId,
+		Subscriptions: make(map[Channel]bool),
+		Attributes:    ns.Attributes,
+		Signature:     ns.Signature,
+		Mcu:           ns.Mcu,
+		Firmware:      ns.Firmware,
+	}
+	nm.Udids[ns.Udid] = newNode
+	nm.Mutex.Unlock()
+
+	clog.Info("Reassigned %s from node %d to node %d", ns.Udid, node, newNode)
+	nm.saveChanges()
+	if ns.Active {
+		nm.requestReaddressing(node)
+	}
+	return nil
+}
+
 func (nm *NodeModel) Subscribe(node Node, channel_id Channel) bool {
 	nm.Mutex.Lock()
 	defer nm.Mutex.Unlock()
@@ -285,22 +532,47 @@ func (nm *NodeModel) GetProperties(node Node) *NodeState {
 			props["attributes"] = make([]string, 0)
 			return props
 		*/
-		return ns
+		return ns.clone()
 	}
 	return nil
 }
 
+// List returns a copy of the state of all active nodes.
+func (nm *NodeModel) List() []NodeState {
+	nm.Mutex.RLock()
+	defer nm.Mutex.RUnlock()
+
+	res := make([]NodeState, 0)
+	for i := 0; i < 128; i++ {
+		if ns := nm.getState(Node(i)); ns != nil {
+			res = append(res, *ns.clone())
+		}
+	}
+	return res
+}
+
 func (nm *NodeModel) DoReboot(node Node) error {
-	nm.Port.SendMessage(NewSystemMessage(node, NOCAN_SYS_NODE_BOOT_REQUEST, 0x01, nil))
-	if nm.Port.WaitForMessage(NewSystemMessageFilter(node, NOCAN_SYS_NODE_BOOT_ACK), DEFAULT_TIMEOUT) == nil {
+	if operation, busy := nm.BusyWith(node); busy {
+		return &NodeBusyError{Node: node, Operation: operation}
+	}
+
+	// If we don't do this and use nm.Port instead, we will conflict with Run()
+	port := nm.createNodePort("reboot", node)
+	defer PortManager.DestroyPort(port)
+
+	port.SendMessage(NewSystemMessage(node, NOCAN_SYS_NODE_BOOT_REQUEST, 0x01, nil))
+	if port.WaitForMessage(NewSystemMessageFilter(node, NOCAN_SYS_NODE_BOOT_ACK), DefaultTimeout()) == nil {
 		return fmt.Errorf("Node %d could not be rebooted", node)
 	}
 	return nil
 }
 
 func (nm *NodeModel) DoPing(node Node) error {
-	nm.Port.SendMessage(NewSystemMessage(node, NOCAN_SYS_NODE_PING, 0, nil))
-	if nm.Port.WaitForMessage(NewSystemMessageFilter(node, NOCAN_SYS_NODE_PING_ACK), DEFAULT_TIMEOUT) == nil {
+	port := nm.createNodePort("ping", node)
+	defer PortManager.DestroyPort(port)
+
+	port.SendMessage(NewSystemMessage(node, NOCAN_SYS_NODE_PING, 0, nil))
+	if port.WaitForMessage(NewSystemMessageFilter(node, NOCAN_SYS_NODE_PING_ACK), DefaultTimeout()) == nil {
 		return fmt.Errorf("Node %d could not be pinged", node)
 	}
 	return nil
@@ -317,13 +589,61 @@ func (nm *NodeModel) ByUdid(uid [8]byte) (Node, bool) {
 	return Node(-1), false
 }
 
-func (nm *NodeModel) Touch(node Node) {
-	nm.Mutex.Lock()
-	defer nm.Mutex.Unlock()
+// Touch updates the last time a node was seen, as well as the interface it
+// was seen on, if known (interfaceId >= 0), and marks the node online.
+func (nm *NodeModel) Touch(node Node, interfaceId int) {
+	var event *NodeStatusEvent
 
+	nm.Mutex.Lock()
 	if ns := nm.getState(node); ns != nil {
 		ns.LastSeen = time.Now()
+		if interfaceId >= 0 {
+			ns.InterfaceId = interfaceId
+		}
+		event = ns.setStatus(NODE_STATUS_ONLINE)
+	}
+	nm.Mutex.Unlock()
+
+	emitNodeStatus(event)
+}
+
+func (nm *NodeModel) InterfaceOf(node Node) (int, bool) {
+	nm.Mutex.RLock()
+	defer nm.Mutex.RUnlock()
+
+	if ns := nm.getState(node); ns != nil && ns.InterfaceId >= 0 {
+		return ns.InterfaceId, true
+	}
+	return -1, false
+}
+
+func (nm *NodeModel) InterfaceOfUdid(node []byte) (int, bool) {
+	if len(node) != 8 {
+		return -1, false
+	}
+
+	nm.Mutex.RLock()
+	defer nm.Mutex.RUnlock()
+
+	if n, ok := nm.Udids[UdidToString(node)]; ok && nm.States[n].InterfaceId >= 0 {
+		return nm.States[n].InterfaceId, true
+	}
+	return -1, false
+}
+
+// SubscribedInterfaces returns the set of interfaces that have at least one
+// node subscribed to the channel.
+func (nm *NodeModel) SubscribedInterfaces(channel_id Channel) map[int]bool {
+	nm.Mutex.RLock()
+	defer nm.Mutex.RUnlock()
+
+	interfaces := make(map[int]bool)
+	for i := 1; i < 128; i++ {
+		if ns := nm.getState(Node(i)); ns != nil && ns.InterfaceId >= 0 && ns.Subscriptions[channel_id] {
+			interfaces[ns.InterfaceId] = true
+		}
 	}
+	return interfaces
 }
 
 func (nm *NodeModel) Each(fn func(Node, *NodeState)) {
@@ -348,143 +668,298 @@ func (nm *NodeModel) getState(node Node) *NodeState {
 }
 
 const (
-	SPM_PAGE_SIZE = 128
-	READ_SIZE     = 2048
+	SPM_PAGE_SIZE       = 128 // see McuInfo.PageSize
+	READ_SIZE           = 2048
+	UPLOAD_PAGE_RETRIES = 3
 )
 
+// DownloadFirmware reads the memory of a node. The node must have been
+// reserved with Reserve, see JobModel.CreateNodeJob.
 func (nm *NodeModel) DownloadFirmware(state *JobState, node Node, memtype byte, memlength uint32) error {
-	var address uint32
-	var i uint32
-	var data [8]byte
-
 	clog.Debug("Initiate down")
-	if !atomic.CompareAndSwapInt32(&nm.Inprogress, 0, 1) {
-		err := fmt.Errorf("Firmware upload or download already in progress, ignoring new request")
-		state.UpdateStatus(JobFailed, err)
+
+	mcu := nm.Mcu(node)
+	if memlength > mcu.MemorySize(memtype) {
+		err := fmt.Errorf("Cannot read %d bytes from node %d, which only has %d bytes available (%s)", memlength, node, mcu.MemorySize(memtype), mcu.Name)
+		state.Fail(err)
 		return err
 	}
-	defer atomic.StoreInt32(&nm.Inprogress, 0)
+	page_size := mcu.PageSize
+
+	release, err := nm.acquireInterface(state.Context, node)
+	if err != nil {
+		state.Fail(err)
+		return err
+	}
+	defer release()
 
 	// If we don't do this and use nm.Port instead, we will conflict with Run()
-	port := PortManager.CreatePort("firmware-download")
+	port := nm.createNodePort("firmware-download", node)
 	defer PortManager.DestroyPort(port)
 
 	port.SendMessage(NewSystemMessage(node, NOCAN_SYS_NODE_BOOT_REQUEST, 0x01, nil))
 
-	if port.WaitForMessage(NewSystemMessageFilter(node, NOCAN_SYS_NODE_BOOT_ACK), EXTENDED_TIMEOUT) == nil {
+	if port.WaitForMessage(NewSystemMessageFilter(node, NOCAN_SYS_NODE_BOOT_ACK), ExtendedTimeout()) == nil {
 		err := fmt.Errorf("NOCAN_SYS_NODE_BOOT_ACK failed for node %d", node)
-		state.UpdateStatus(JobFailed, err)
+		state.Fail(err)
 		return err
 	}
 
+	// leave the bootloader in all cases, since nothing was written
+	ihex, err := readMemory(state, port, node, memtype, memlength, page_size)
+	leaveBootloader(port, node)
+	if err != nil {
+		state.Fail(err)
+		return err
+	}
+
+	var buf bytes.Buffer
+	ihex.Save(&buf)
+	state.SetResult(buf.Bytes(), "")
+	state.UpdateProgress(100)
+	state.UpdateStatus(JobCompleted, nil)
+	return nil
+}
+
+// readMemory reads the memory of a node in its bootloader, page by page.
+func readMemory(state *JobState, port *Port, node Node, memtype byte, memlength uint32, page_size uint32) (*intelhex.IntelHex, error) {
+	var address uint32
+	var i uint32
+	var data [8]byte
+
 	ihex := intelhex.New()
 
-	for i = 0; i < memlength/SPM_PAGE_SIZE; i++ {
-		address = i * SPM_PAGE_SIZE
-		data[0] = 0
-		data[1] = 0
+	for i = 0; i < memlength/page_size; i++ {
+		address = i * page_size
+		if err := state.Cancelled(); err != nil {
+			return nil, err
+		}
+		data[0] = byte(address >> 24)
+		data[1] = byte(address >> 16)
 		data[2] = byte(address >> 8)
 		data[3] = byte(address & 0xFF)
 		port.SendMessage(NewSystemMessage(node, NOCAN_SYS_BOOTLOADER_SET_ADDRESS, memtype, data[:4]))
-		if port.WaitForMessage(NewSystemMessageFilter(node, NOCAN_SYS_BOOTLOADER_SET_ADDRESS_ACK), DEFAULT_TIMEOUT) == nil {
-			err := fmt.Errorf("NOCAN_SYS_BOOTLOADER_SET_ADDRESS failed for node %d at address=0x%x", node, address)
-			state.UpdateStatus(JobFailed, err)
-			return err
+		if port.WaitForMessage(NewSystemMessageFilter(node, NOCAN_SYS_BOOTLOADER_SET_ADDRESS_ACK), DefaultTimeout()) == nil {
+			return nil, fmt.Errorf("NOCAN_SYS_BOOTLOADER_SET_ADDRESS failed for node %d at address=0x%x", node, address)
 		}
-		for pos := 0; pos < SPM_PAGE_SIZE; pos += 8 {
+		for pos := uint32(0); pos < page_size; pos += 8 {
 			port.SendMessage(NewSystemMessage(node, NOCAN_SYS_BOOTLOADER_READ, 8, nil))
-			response := port.WaitForMessage(NewSystemMessageFilter(node, NOCAN_SYS_BOOTLOADER_READ_ACK), DEFAULT_TIMEOUT)
+			response := port.WaitForMessage(NewSystemMessageFilter(node, NOCAN_SYS_BOOTLOADER_READ_ACK), DefaultTimeout())
 			if response == nil {
-				err := fmt.Errorf("NOCAN_SYS_BOOTLOADER_READ failed for node %d at address=0x%x", node, address)
-				state.UpdateStatus(JobFailed, err)
-				return err
+				return nil, fmt.Errorf("NOCAN_SYS_BOOTLOADER_READ failed for node %d at address=0x%x", node, address)
 			}
 			ihex.Add(0, address, response.Data)
 			address += 8
 		}
 		state.UpdateProgress(uint(address * 100 / memlength))
 	}
-	var buf bytes.Buffer
-	ihex.Save(&buf)
-	state.Result = buf.Bytes()
+	return ihex, nil
+}
+
+// UploadReport is the result of a firmware upload job.
+type UploadReport struct {
+	Node          Node    `json:"node"`
+	Memory        string  `json:"memory"`
+	Bytes         uint32  `json:"bytes"`
+	Pages         int     `json:"pages"`
+	Retries       int     `json:"retries"`
+	Delta         bool    `json:"delta"`
+	SkippedPages  int     `json:"skipped_pages"` // pages left untouched by a delta upload
+	Verified      bool    `json:"verified"`
+	Rebooted      bool    `json:"rebooted"`
+	WriteSeconds  float64 `json:"write_seconds"`
+	RebootSeconds float64 `json:"reboot_seconds"`
+	TotalSeconds  float64 `json:"total_seconds"`
+}
+
+func setAddress(port *Port, node Node, memtype byte, address uint32) error {
+	data := []byte{byte(address >> 24), byte(address >> 16), byte(address >> 8), byte(address)}
+	port.SendMessage(NewSystemMessage(node, NOCAN_SYS_BOOTLOADER_SET_ADDRESS, memtype, data))
+	response := port.WaitForMessage(NewSystemMessageFilter(node, NOCAN_SYS_BOOTLOADER_SET_ADDRESS_ACK), DefaultTimeout())
+	if response == nil || response.Id.GetSysParam() != 0 {
+		return fmt.Errorf("NOCAN_SYS_BOOTLOADER_SET_ADDRESS failed for node %d at address=0x%x", node, address)
+	}
+	return nil
+}
+
+// writePage writes a page of data, then reads it back to verify it.
+func writePage(port *Port, node Node, memtype byte, address uint32, page []byte) error {
+	if err := setAddress(port, node, memtype, address); err != nil {
+		return err
+	}
+	for pos := 0; pos < len(page); pos += 8 {
+		end := pos + 8
+		if end > len(page) {
+			end = len(page)
+		}
+		port.SendMessage(NewSystemMessage(node, NOCAN_SYS_BOOTLOADER_WRITE, 0, page[pos:end]))
+		response := port.WaitForMessage(NewSystemMessageFilter(node, NOCAN_SYS_BOOTLOADER_WRITE_ACK), DefaultTimeout())
+		if response == nil || response.Id.GetSysParam() != 0 {
+			return fmt.Errorf("NOCAN_SYS_BOOTLOADER_WRITE failed for node %d at address=0x%x", node, address+uint32(pos))
+		}
+	}
+	port.SendMessage(NewSystemMessage(node, NOCAN_SYS_BOOTLOADER_WRITE, 1, nil))
+	response := port.WaitForMessage(NewSystemMessageFilter(node, NOCAN_SYS_BOOTLOADER_WRITE_ACK), DefaultTimeout())
+	if response == nil || response.Id.GetSysParam() != 0 {
+		return fmt.Errorf("Final NOCAN_SYS_BOOTLOADER_WRITE failed for node %d at address=0x%x", node, address)
+	}
+
+	current, err := readPage(port, node, memtype, address, len(page))
+	if err != nil {
+		return err
+	}
+	for pos := range current {
+		if current[pos] != page[pos] {
+			return fmt.Errorf("Verification failed for node %d at address=0x%x", node, address+uint32(pos))
+		}
+	}
+	return nil
+}
+
+// UploadFirmware writes and verifies each page of the firmware, retrying
+// pages up to UPLOAD_PAGE_RETRIES times, then leaves the bootloader and waits
+// for the node to get its address again. In delta mode, pages that already
+// hold the right data are read but not written. The job result is an
+// UploadReport in JSON. The node must have been reserved with Reserve, see
+// JobModel.CreateNodeJob. After a flash upload, firmware is recorded as the
+// firmware of the node: it is the id of the repository image that was
+// uploaded, or empty for other images.
+func (nm *NodeModel) UploadFirmware(state *JobState, node Node, memtype byte, ihex *intelhex.IntelHex, delta bool, firmware string) error {
+	report, err := nm.flashFirmware(state.Context, node, memtype, ihex, delta, state.UpdateProgress)
+	if err != nil {
+		state.Fail(err)
+		return err
+	}
+	if memtype == 'F' {
+		nm.SetFirmware(node, firmware)
+	}
+
+	result, err := json.Marshal(report)
+	if err != nil {
+		state.Fail(err)
+		return err
+	}
+	state.SetResult(result, "application/json")
 	state.UpdateProgress(100)
 	state.UpdateStatus(JobCompleted, nil)
 	return nil
 }
 
-func (nm *NodeModel) UploadFirmware(state *JobState, node Node, memtype byte, ihex *intelhex.IntelHex) error {
-	var address uint32
-	var data [8]byte
+// flashFirmware performs an upload on a reserved node. If ctx is cancelled,
+// the upload stops before the next page and the node stays in its bootloader,
+// since its firmware is incomplete.
+func (nm *NodeModel) flashFirmware(ctx context.Context, node Node, memtype byte, ihex *intelhex.IntelHex, delta bool, progress func(uint)) (*UploadReport, error) {
+	start := time.Now()
+	report := &UploadReport{Node: node, Memory: MemoryName(memtype), Delta: delta}
+
+	if err := nm.ValidateImage(node, memtype, ihex); err != nil {
+		return nil, err
+	}
+	mcu := nm.Mcu(node)
+	pages := splitPages(ihex, mcu.PageSize)
+	for _, page := range pages {
+		report.Bytes += uint32(len(page.Data))
+	}
 
-	if !atomic.CompareAndSwapInt32(&nm.Inprogress, 0, 1) {
-		return fmt.Errorf("Firmware upload or download already in progress, ignoring new request")
+	release, err := nm.acquireInterface(ctx, node)
+	if err != nil {
+		return nil, err
 	}
-	defer atomic.StoreInt32(&nm.Inprogress, 0)
+	defer release()
 
 	// If we don't do this and use nm.Port instead, we will conflict with Run()
-	port := PortManager.CreatePort("firmware-upload")
+	port := nm.createNodePort("firmware-upload", node)
 	defer PortManager.DestroyPort(port)
 
 	port.SendMessage(NewSystemMessage(node, NOCAN_SYS_NODE_BOOT_REQUEST, 0x01, nil))
 
-	if port.WaitForMessage(NewSystemMessageFilter(node, NOCAN_SYS_NODE_BOOT_ACK), EXTENDED_TIMEOUT) == nil {
+	if port.WaitForMessage(NewSystemMessageFilter(node, NOCAN_SYS_NODE_BOOT_ACK), ExtendedTimeout()) == nil {
 		err := fmt.Errorf("NOCAN_SYS_NODE_BOOT_ACK failed for node %d", node)
-		state.UpdateStatus(JobFailed, err)
-		return err
+		return nil, err
 	}
 
-	for _, block := range ihex.Blocks {
-		blocksize := uint32(len(block.Data))
-
-		for page_offset := uint32(0); page_offset < blocksize; page_offset += SPM_PAGE_SIZE {
-			base_address := block.Address + page_offset
-			data[0] = 0
-			data[1] = 0
-			data[2] = byte(base_address >> 8)
-			data[3] = byte(base_address & 0xFF)
-			port.SendMessage(NewSystemMessage(node, NOCAN_SYS_BOOTLOADER_SET_ADDRESS, memtype, data[:4]))
-			if port.WaitForMessage(NewSystemMessageFilter(node, NOCAN_SYS_BOOTLOADER_SET_ADDRESS_ACK), DEFAULT_TIMEOUT) == nil {
-				err := fmt.Errorf("NOCAN_SYS_BOOTLOADER_SET_ADDRESS failed for node %d at address=0x%x", node, address)
-				state.UpdateStatus(JobFailed, err)
-				return err
-			}
+	var written uint32
+	for _, page := range pages {
+		if ctx.Err() != nil {
+			err := fmt.Errorf("Upload to node %d was cancelled after writing %d of %d bytes, the node was left in its bootloader", node, written, report.Bytes)
+			return nil, err
+		}
 
-			for page_pos := uint32(0); page_pos < SPM_PAGE_SIZE && page_offset+page_pos < blocksize; page_pos += 8 {
-				rlen := block.Copy(data[:], page_offset+page_pos, 8)
-				port.SendMessage(NewSystemMessage(node, NOCAN_SYS_BOOTLOADER_WRITE, 0, data[:rlen]))
-				response := port.WaitForMessage(NewSystemMessageFilter(node, NOCAN_SYS_BOOTLOADER_WRITE_ACK), DEFAULT_TIMEOUT)
-				if response == nil {
-					err := fmt.Errorf("NOCAN_SYS_BOOTLOADER_WRITE failed for node %d at address=0x%x", node, address)
-					state.UpdateStatus(JobFailed, err)
-					return err
+		if delta && pageUnchanged(port, node, memtype, page) {
+			report.SkippedPages++
+		} else {
+			var err error
+			for attempt := 0; attempt <= UPLOAD_PAGE_RETRIES; attempt++ {
+				if attempt > 0 {
+					clog.Warning("Retrying page at 0x%x for node %d (attempt %d): %s", page.Address, node, attempt, err.Error())
+					report.Retries++
+				}
+				if err = writePage(port, node, memtype, page.Address, page.Data); err == nil {
+					break
 				}
 			}
-			port.SendMessage(NewSystemMessage(node, NOCAN_SYS_BOOTLOADER_WRITE, 1, nil))
-			response := port.WaitForMessage(NewSystemMessageFilter(node, NOCAN_SYS_BOOTLOADER_WRITE_ACK), DEFAULT_TIMEOUT)
-			if response == nil {
-				err := fmt.Errorf("Final NOCAN_SYS_BOOTLOADER_WRITE failed for node %d at address=0x%x", node, address)
-				state.UpdateStatus(JobFailed, err)
-				return err
+			if err != nil {
+				err = fmt.Errorf("%s, after %d retries", err.Error(), UPLOAD_PAGE_RETRIES)
+				return nil, err
 			}
-			state.UpdateProgress(uint((page_offset * 100) / blocksize))
+			report.Pages++
 		}
+		written += uint32(len(page.Data))
+		progress(uint((written * 100) / report.Bytes))
 	}
-	state.Result = nil
-	state.UpdateProgress(100)
-	state.UpdateStatus(JobCompleted, nil)
-	return nil
+	report.Verified = true
+	report.WriteSeconds = time.Since(start).Seconds()
+
+	port.SendMessage(NewSystemMessage(node, NOCAN_SYS_BOOTLOADER_LEAVE, 0, nil))
+	if port.WaitForMessage(NewSystemMessageFilter(node, NOCAN_SYS_BOOTLOADER_LEAVE_ACK), DefaultTimeout()) == nil {
+		err := fmt.Errorf("Firmware was written and verified, but NOCAN_SYS_BOOTLOADER_LEAVE failed for node %d", node)
+		return nil, err
+	}
+
+	rebootStart := time.Now()
+	if !waitForRejoin(port, node) {
+		err := fmt.Errorf("Firmware was written and verified, but node %d did not get its address back after leaving the bootloader", node)
+		return nil, err
+	}
+	report.Rebooted = true
+	report.RebootSeconds = time.Since(rebootStart).Seconds()
+	report.TotalSeconds = time.Since(start).Seconds()
+
+	clog.Info("Uploaded and verified %d bytes in %d pages to node %d in %.1fs (%d retries, %d unchanged pages skipped)", report.Bytes, report.Pages, node, report.TotalSeconds, report.Retries, report.SkippedPages)
+	return report, nil
 }
 
-func (nm *NodeModel) Run() {
+// Run processes node messages until ctx is cancelled, and saves the node
+// information before returning.
+func (nm *NodeModel) Run(ctx context.Context) {
 	for {
-		m := <-nm.Port.Input
+		var m *Message
+
+		select {
+		case m = <-nm.Port.Input:
+		case <-ctx.Done():
+			if err := nm.SaveToFile(); err != nil {
+				clog.Warning("Failed to save node info: %s", err.Error())
+			}
+			return
+		}
 
-		nm.Touch(m.Id.GetNode())
+		interfaceId := Interfaces.InterfaceIdOf(m)
+
+		// only traffic coming from the bus proves that a node is alive
+		if interfaceId >= 0 {
+			nm.Touch(m.Id.GetNode(), interfaceId)
+		}
 
 		if m.Id.IsSystem() {
 			switch m.Id.GetSysFunc() {
 			case NOCAN_SYS_ADDRESS_REQUEST:
-				node_id, err := nm.Register(m.Data)
+				node_id, err := nm.Register(m.Data, interfaceId)
+				if err == NodePendingError {
+					// the node will ask again, until it is approved
+					clog.Debug("NOCAN_SYS_ADDRESS_REQUEST: %s is waiting for approval", UdidToString(m.Data))
+					break
+				}
 				if err != nil {
 					clog.Warning("NOCAN_SYS_ADDRESS_REQUEST: Failed to register %s, %s", UdidToString(m.Data), err.Error())
 				} else {
@@ -0,0 +1,115 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"pannetrat.com/nocan/clog"
+)
+
+// NodeBusyError is returned when an operation is requested on a node that is
+// already reserved by another one.
+type NodeBusyError struct {
+	Node      Node
+	Operation string
+}
+
+func (e *NodeBusyError) Error() string {
+	return fmt.Sprintf("Node %d is busy: %s in progress", e.Node, e.Operation)
+}
+
+// Reserve marks nodes as busy with an operation, such as a firmware upload.
+// Either all nodes are reserved or none are, in which case a NodeBusyError
+// is returned for the first busy node.
+func (nm *NodeModel) Reserve(operation string, nodes ...Node) error {
+	nm.BusyMutex.Lock()
+	defer nm.BusyMutex.Unlock()
+
+	for _, node := range nodes {
+		if current, ok := nm.Busy[node]; ok {
+			return &NodeBusyError{Node: node, Operation: current}
+		}
+	}
+	for _, node := range nodes {
+		nm.Busy[node] = operation
+	}
+	return nil
+}
+
+func (nm *NodeModel) Release(nodes ...Node) {
+	nm.BusyMutex.Lock()
+	defer nm.BusyMutex.Unlock()
+
+	for _, node := range nodes {
+		delete(nm.Busy, node)
+	}
+}
+
+// BusyWith returns the operation a node is reserved for, if any.
+func (nm *NodeModel) BusyWith(node Node) (string, bool) {
+	nm.BusyMutex.Lock()
+	defer nm.BusyMutex.Unlock()
+
+	operation, ok := nm.Busy[node]
+	return operation, ok
+}
+
+// acquireInterface waits until fewer than FirmwareJobsPerInterface firmware
+// operations are running on the interface of a node, and returns a function
+// that releases the slot. Nodes whose interface is not known yet share a
+// single slot. It fails if ctx is cancelled while waiting.
+func (nm *NodeModel) acquireInterface(ctx context.Context, node Node) (func(), error) {
+	interfaceId, ok := nm.InterfaceOf(node)
+	if !ok {
+		interfaceId = -1
+	}
+
+	nm.BusyMutex.Lock()
+	slots, ok := nm.InterfaceSlots[interfaceId]
+	if !ok {
+		size := nm.FirmwareJobsPerInterface
+		if size < 1 {
+			size = 1
+		}
+		slots = make(chan struct{}, size)
+		nm.InterfaceSlots[interfaceId] = slots
+	}
+	nm.BusyMutex.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+	default:
+		clog.Info("Node %d is waiting for another firmware operation to complete on interface %d", node, interfaceId)
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("Operation on node %d was cancelled while waiting for interface %d", node, interfaceId)
+		}
+	}
+	return func() { <-slots }, nil
+}
+
+// createNodePort creates a port that only receives the system messages sent
+// from a bus by a node, so that operations on other nodes do not fill its
+// queue.
+func (nm *NodeModel) createNodePort(name string, node Node) *Port {
+	return PortManager.CreateFilteredPort(name, func(m *Message) bool {
+		return m.Id.IsSystem() && m.Id.GetNode() == node && Interfaces.ByPort(m.SourcePort) != nil
+	})
+}
+
+// waitForRejoin waits until a node that left its bootloader has requested
+// and been given its address again, so that it can accept new requests.
+func waitForRejoin(port *Port, node Node) bool {
+	return port.WaitForMessage(NewSystemMessageFilter(node, NOCAN_SYS_ADDRESS_CONFIGURE_ACK), ExtendedTimeout()) != nil
+}
+
+// leaveBootloader makes a node that was only read from return to its
+// application, and waits for it to rejoin. Failures are only logged.
+func leaveBootloader(port *Port, node Node) {
+	port.SendMessage(NewSystemMessage(node, NOCAN_SYS_BOOTLOADER_LEAVE, 0, nil))
+	if port.WaitForMessage(NewSystemMessageFilter(node, NOCAN_SYS_BOOTLOADER_LEAVE_ACK), DefaultTimeout()) == nil {
+		clog.Warning("NOCAN_SYS_BOOTLOADER_LEAVE failed for node %d", node)
+	} else if !waitForRejoin(port, node) {
+		clog.Warning("Node %d did not get its address back after leaving the bootloader", node)
+	}
+}
@@ -0,0 +1,266 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"pannetrat.com/nocan/clog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type AllocationMode string
+
+const (
+	ALLOCATION_MODE_OPEN      AllocationMode = "open"      // any node gets an address
+	ALLOCATION_MODE_ALLOWLIST AllocationMode = "allowlist" // only known or pinned nodes get an address
+	ALLOCATION_MODE_APPROVAL  AllocationMode = "approval"  // unknown nodes wait for an operator
+)
+
+// Nodes waiting for approval are forgotten when they stop requesting an
+// address, and the queue is bounded so that a misbehaving bus cannot fill it.
+const (
+	PENDING_NODE_EXPIRY = 10 * time.Minute
+	MAX_PENDING_NODES   = 64
+)
+
+var (
+	NodeRefusedError = errors.New("Node is not allowed on this network")
+	NodePendingError = errors.New("Node is waiting for approval")
+)
+
+type NodeRange struct {
+	First Node
+	Last  Node
+}
+
+// AllocationPolicy controls how ids are given to nodes that are not yet
+// known. Nodes already listed in the node file always keep their id.
+type AllocationPolicy struct {
+	Mode     AllocationMode
+	Reserved []NodeRange     // ids that are never allocated automatically
+	Pins     map[string]Node // UDID to id mappings, for nodes seen for the first time
+}
+
+type PendingNode struct {
+	Udid        string    `json:"udid"`
+	InterfaceId int       `json:"interface"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+func ParseAllocationMode(s string) (AllocationMode, error) {
+	switch AllocationMode(s) {
+	case ALLOCATION_MODE_OPEN, ALLOCATION_MODE_ALLOWLIST, ALLOCATION_MODE_APPROVAL:
+		return AllocationMode(s), nil
+	}
+	return ALLOCATION_MODE_OPEN, fmt.Errorf("Unknown allocation mode '%s', expected open, allowlist or approval", s)
+}
+
+func parseNodeId(s string) (Node, error) {
+	id, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || id < 1 || id > 127 {
+		return Node(-1), fmt.Errorf("Incorrect node id '%s', expected a number between 1 and 127", s)
+	}
+	return Node(id), nil
+}
+
+// ParseNodeRange accepts a single id (e.g. "5") or a range (e.g. "10-20").
+func ParseNodeRange(s string) (NodeRange, error) {
+	var r NodeRange
+	var err error
+
+	parts := strings.SplitN(s, "-", 2)
+	if r.First, err = parseNodeId(parts[0]); err != nil {
+		return r, err
+	}
+	r.Last = r.First
+	if len(parts) == 2 {
+		if r.Last, err = parseNodeId(parts[1]); err != nil {
+			return r, err
+		}
+	}
+	if r.Last < r.First {
+		return r, fmt.Errorf("Incorrect node range '%s'", s)
+	}
+	return r, nil
+}
+
+// ParseNodePin accepts a "udid=id" mapping.
+func ParseNodePin(s string) (string, Node, error) {
+	var udid [8]byte
+
+	i := strings.LastIndex(s, "=")
+	if i < 0 {
+		return "", Node(-1), fmt.Errorf("Incorrect pin '%s', expected udid=id", s)
+	}
+	if err := StringToUdid(s[:i], udid[:]); err != nil || len(s[:i]) != 23 {
+		return "", Node(-1), fmt.Errorf("Incorrect UDID in pin '%s'", s)
+	}
+	id, err := parseNodeId(s[i+1:])
+	if err != nil {
+		return "", Node(-1), err
+	}
+	return UdidToString(udid[:]), id, nil
+}
+
+func (policy *AllocationPolicy) isReserved(id Node, udid string) bool {
+	for _, r := range policy.Reserved {
+		if id >= r.First && id <= r.Last {
+			return true
+		}
+	}
+	for u, n := range policy.Pins {
+		if n == id && u != udid {
+			return true
+		}
+	}
+	return false
+}
+
+func (policy *AllocationPolicy) isPinned(udid string) bool {
+	_, ok := policy.Pins[udid]
+	return ok
+}
+
+// normalizeUdid returns the canonical form of a UDID given by a user, as used
+// in the maps of NodeModel (lowercase hexadecimal).
+func normalizeUdid(udid string) (string, error) {
+	var uid [8]byte
+
+	if len(udid) != 23 {
+		return "", fmt.Errorf("Incorrect UDID '%s'", udid)
+	}
+	if err := StringToUdid(udid, uid[:]); err != nil {
+		return "", fmt.Errorf("Incorrect UDID '%s': %s", udid, err.Error())
+	}
+	return UdidToString(uid[:]), nil
+}
+
+// expirePending must be called with the lock held.
+func (nm *NodeModel) expirePending(now time.Time) {
+	for udid, pending := range nm.Pending {
+		if now.Sub(pending.LastSeen) > PENDING_NODE_EXPIRY {
+			clog.Info("Node %s stopped waiting for approval", udid)
+			delete(nm.Pending, udid)
+		}
+	}
+}
+
+// allocate must be called with the lock held. It returns the id to give to a
+// new node, or -1 if none is available.
+func (nm *NodeModel) allocate(udid string) (Node, error) {
+	if id, ok := nm.Policy.Pins[udid]; ok {
+		if nm.States[id] != nil {
+			return Node(-1), fmt.Errorf("Node id %d pinned to %s is already used by %s", id, udid, nm.States[id].Udid)
+		}
+		return id, nil
+	}
+	for i := 1; i < 128; i++ {
+		if nm.States[i] == nil && !nm.Policy.isReserved(Node(i), udid) {
+			return Node(i), nil
+		}
+	}
+	return Node(-1), errors.New("Maximum number of nodes has been reached.")
+}
+
+// admit must be called with the lock held. It applies the allocation mode
+// to a node that is not yet known.
+func (nm *NodeModel) admit(udid string, interfaceId int) error {
+	if nm.Policy.isPinned(udid) {
+		return nil
+	}
+	switch nm.Policy.Mode {
+	case ALLOCATION_MODE_ALLOWLIST:
+		return NodeRefusedError
+	case ALLOCATION_MODE_APPROVAL:
+		now := time.Now()
+		if pending, ok := nm.Pending[udid]; ok {
+			pending.LastSeen = now
+			pending.InterfaceId = interfaceId
+			return NodePendingError
+		}
+		nm.expirePending(now)
+		if len(nm.Pending) >= MAX_PENDING_NODES {
+			clog.Warning("Node %s cannot wait for approval, %d nodes are already waiting", udid, len(nm.Pending))
+			return NodeRefusedError
+		}
+		nm.Pending[udid] = &PendingNode{Udid: udid, InterfaceId: interfaceId, FirstSeen: now, LastSeen: now}
+		clog.Info("Node %s is waiting for approval", udid)
+		return NodePendingError
+	}
+	return nil
+}
+
+func (nm *NodeModel) EachPending(fn func(*PendingNode)) {
+	nm.Mutex.Lock()
+	defer nm.Mutex.Unlock()
+
+	nm.expirePending(time.Now())
+	for _, pending := range nm.Pending {
+		fn(pending)
+	}
+}
+
+// Approve gives an address to a node waiting for approval, either the
+// requested id or, if id is -1, the next one allowed by the policy. Reserved
+// ids can only be requested for the node they are pinned to. The node is then
+// sent its address.
+func (nm *NodeModel) Approve(udid string, id Node) (Node, error) {
+	var uid [8]byte
+
+	udid, err := normalizeUdid(udid)
+	if err != nil {
+		return Node(-1), err
+	}
+	StringToUdid(udid, uid[:])
+
+	nm.Mutex.Lock()
+	pending, ok := nm.Pending[udid]
+	if !ok {
+		nm.Mutex.Unlock()
+		return Node(-1), NodeNotFoundError
+	}
+	if id < 0 {
+		var err error
+		if id, err = nm.allocate(udid); err != nil {
+			nm.Mutex.Unlock()
+			return Node(-1), err
+		}
+	} else if id == 0 || nm.States[id] != nil {
+		nm.Mutex.Unlock()
+		return Node(-1), fmt.Errorf("Node id %d is not available", id)
+	} else if pin, pinned := nm.Policy.Pins[udid]; nm.Policy.isReserved(id, udid) && !(pinned && pin == id) {
+		nm.Mutex.Unlock()
+		return Node(-1), fmt.Errorf("Node id %d is reserved", id)
+	}
+	delete(nm.Pending, udid)
+	nm.States[id] = &NodeState{Active: true, Udid: udid, Id: id, InterfaceId: pending.InterfaceId, LastSeen: time.Now(), Subscriptions: make(map[Channel]bool)}
+	nm.Udids[udid] = id
+	event := nm.States[id].setStatus(NODE_STATUS_ONLINE)
+	nm.Mutex.Unlock()
+
+	clog.Info("Approved %s as node %d", udid, id)
+	emitNodeStatus(event)
+	nm.saveChanges()
+	nm.Port.SendMessage(NewSystemMessage(0, NOCAN_SYS_ADDRESS_CONFIGURE, uint8(id), uid[:]))
+	return id, nil
+}
+
+// Reject removes a node from the approval queue. It will appear again if it
+// keeps requesting an address.
+func (nm *NodeModel) Reject(udid string) error {
+	udid, err := normalizeUdid(udid)
+	if err != nil {
+		return err
+	}
+
+	nm.Mutex.Lock()
+	defer nm.Mutex.Unlock()
+
+	if _, ok := nm.Pending[udid]; !ok {
+		return NodeNotFoundError
+	}
+	delete(nm.Pending, udid)
+	return nil
+}
@@ -0,0 +1,134 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+// newPolicyTestModel returns a node model that is not connected to the bus:
+// its port receives nothing, so that it cannot hold back other ports.
+func newPolicyTestModel(t *testing.T, policy AllocationPolicy) *NodeModel {
+	nm := NewNodeModel()
+	PortManager.DestroyPort(nm.Port)
+	nm.Port = PortManager.CreateFilteredPort("policy-test", func(*Message) bool { return false })
+	t.Cleanup(func() { PortManager.DestroyPort(nm.Port) })
+	if policy.Pins == nil {
+		policy.Pins = make(map[string]Node)
+	}
+	nm.Policy = policy
+	return nm
+}
+
+func testUdid(i int) []byte {
+	return []byte{0xAA, 0xBB, 0, 0, 0, 0, byte(i >> 8), byte(i)}
+}
+
+func TestAllocationReserved(t *testing.T) {
+	pinned := UdidToString(testUdid(1))
+	nm := newPolicyTestModel(t, AllocationPolicy{
+		Mode:     ALLOCATION_MODE_OPEN,
+		Reserved: []NodeRange{{1, 10}},
+		Pins:     map[string]Node{pinned: 5},
+	})
+
+	if node, err := nm.Register(testUdid(2), 0); err != nil || node != 11 {
+		t.Errorf("First node got %d (%v), expected 11", node, err)
+	}
+	if node, err := nm.Register(testUdid(1), 0); err != nil || node != 5 {
+		t.Errorf("Pinned node got %d (%v), expected 5", node, err)
+	}
+	if node, err := nm.Register(testUdid(2), 0); err != nil || node != 11 {
+		t.Errorf("Known node got %d (%v), expected to keep 11", node, err)
+	}
+	if node, err := nm.Register(testUdid(3), 0); err != nil || node != 12 {
+		t.Errorf("Third node got %d (%v), expected 12", node, err)
+	}
+}
+
+func TestAllocationAllowlist(t *testing.T) {
+	nm := newPolicyTestModel(t, AllocationPolicy{
+		Mode: ALLOCATION_MODE_ALLOWLIST,
+		Pins: map[string]Node{UdidToString(testUdid(1)): 20},
+	})
+
+	if _, err := nm.Register(testUdid(2), 0); err != NodeRefusedError {
+		t.Errorf("Unknown node was not refused: %v", err)
+	}
+	if node, err := nm.Register(testUdid(1), 0); err != nil || node != 20 {
+		t.Errorf("Pinned node got %d (%v), expected 20", node, err)
+	}
+}
+
+func TestAllocationApproval(t *testing.T) {
+	pinned := UdidToString(testUdid(1))
+	nm := newPolicyTestModel(t, AllocationPolicy{
+		Mode:     ALLOCATION_MODE_APPROVAL,
+		Reserved: []NodeRange{{100, 127}},
+		Pins:     map[string]Node{pinned: 100},
+	})
+
+	if _, err := nm.Register(testUdid(2), 0); err != NodePendingError {
+		t.Fatalf("Unknown node is not pending: %v", err)
+	}
+	udid := UdidToString(testUdid(2))
+	count := 0
+	nm.EachPending(func(pending *PendingNode) {
+		if pending.Udid == udid {
+			count++
+		}
+	})
+	if count != 1 {
+		t.Fatalf("Node %s is listed %d times as pending", udid, count)
+	}
+
+	if _, err := nm.Approve("AA:BB:00:00:00:00:00:02", 110); err == nil {
+		t.Errorf("Node was approved with reserved id 110")
+	}
+	if node, err := nm.Approve("AA:BB:00:00:00:00:00:02", 30); err != nil || node != 30 {
+		t.Errorf("Approval with an uppercase UDID gave %d (%v), expected 30", node, err)
+	}
+	if node, ok := nm.Lookup(testUdid(2)); !ok || node != 30 {
+		t.Errorf("Approved node is %d, %v", node, ok)
+	}
+	if err := nm.Reject(udid); err != NodeNotFoundError {
+		t.Errorf("Approved node is still pending: %v", err)
+	}
+
+	// a pinned node is admitted without approval, but it can also be
+	// approved with its reserved id if it was queued before being pinned
+	delete(nm.Policy.Pins, pinned)
+	if _, err := nm.Register(testUdid(1), 0); err != NodePendingError {
+		t.Fatalf("Unknown node is not pending: %v", err)
+	}
+	nm.Policy.Pins[pinned] = 100
+	if node, err := nm.Approve(pinned, 100); err != nil || node != 100 {
+		t.Errorf("Pinned node was approved as %d (%v), expected 100", node, err)
+	}
+}
+
+func TestPendingLimits(t *testing.T) {
+	nm := newPolicyTestModel(t, AllocationPolicy{Mode: ALLOCATION_MODE_APPROVAL})
+
+	for i := 0; i < MAX_PENDING_NODES; i++ {
+		if _, err := nm.Register(testUdid(i), 0); err != NodePendingError {
+			t.Fatalf("Node %d is not pending: %v", i, err)
+		}
+	}
+	if _, err := nm.Register(testUdid(MAX_PENDING_NODES), 0); err != NodeRefusedError {
+		t.Errorf("Node was queued beyond the limit: %v", err)
+	}
+	// nodes already waiting can keep asking
+	if _, err := nm.Register(testUdid(0), 0); err != NodePendingError {
+		t.Errorf("Waiting node is not pending anymore: %v", err)
+	}
+
+	nm.Mutex.Lock()
+	nm.Pending[UdidToString(testUdid(1))].LastSeen = time.Now().Add(-PENDING_NODE_EXPIRY - time.Second)
+	nm.Mutex.Unlock()
+	if _, err := nm.Register(testUdid(MAX_PENDING_NODES), 0); err != NodePendingError {
+		t.Errorf("Node was not queued after another one expired: %v", err)
+	}
+	if err := nm.Reject(UdidToString(testUdid(1))); err != NodeNotFoundError {
+		t.Errorf("Expired node is still pending: %v", err)
+	}
+}
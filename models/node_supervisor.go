@@ -0,0 +1,125 @@
+package models
+
+import (
+	"context"
+	"pannetrat.com/nocan/clog"
+	"time"
+)
+
+type NodeStatus string
+
+const (
+	NODE_STATUS_ONLINE  NodeStatus = "online"
+	NODE_STATUS_SUSPECT NodeStatus = "suspect"
+	NODE_STATUS_OFFLINE NodeStatus = "offline"
+)
+
+const (
+	NODE_SUPERVISE_INTERVAL = 5 * time.Second
+	NODE_STATUS_EVENT       = "node_status"
+)
+
+type NodeStatusEvent struct {
+	Time     time.Time  `json:"time"`
+	Node     Node       `json:"node"`
+	Udid     string     `json:"udid"`
+	Status   NodeStatus `json:"status"`
+	Previous NodeStatus `json:"previous"`
+	LastSeen time.Time  `json:"last_seen"`
+}
+
+// setStatus must be called with the lock held. It returns the event to emit
+// once the lock is released, if the status changed.
+func (ns *NodeState) setStatus(status NodeStatus) *NodeStatusEvent {
+	if ns.Status == status {
+		return nil
+	}
+	event := &NodeStatusEvent{
+		Time:     time.Now(),
+		Node:     ns.Id,
+		Udid:     ns.Udid,
+		Status:   status,
+		Previous: ns.Status,
+		LastSeen: ns.LastSeen,
+	}
+	ns.Status = status
+	return event
+}
+
+func emitNodeStatus(event *NodeStatusEvent) {
+	if event == nil {
+		return
+	}
+	if event.Status == NODE_STATUS_ONLINE {
+		clog.Info("Node %d (%s) is now %s", event.Node, event.Udid, event.Status)
+	} else {
+		clog.Warning("Node %d (%s) is now %s, last seen %s", event.Node, event.Udid, event.Status, event.LastSeen.Format(time.RFC3339))
+	}
+	Events.Emit(NODE_STATUS_EVENT, event)
+}
+
+// Supervise periodically pings nodes that have been quiet for more than
+// PingInterval, and marks them suspect or offline after SuspectAfter and
+// OfflineAfter without any traffic. Nodes that are busy with an operation are
+// left alone. Replies are seen by Run(), which brings nodes back online. It
+// stops when ctx is cancelled.
+func (nm *NodeModel) Supervise(ctx context.Context) {
+	if nm.PingInterval <= 0 {
+		clog.Info("Node liveness monitoring is disabled")
+		return
+	}
+
+	// this port only sends pings
+	port := PortManager.CreateFilteredPort("supervisor", func(m *Message) bool { return false })
+	defer PortManager.DestroyPort(port)
+
+	pinged := make(map[Node]time.Time)
+
+	ticker := time.NewTicker(NODE_SUPERVISE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		var events []*NodeStatusEvent
+		var pings []Node
+		var now time.Time
+
+		select {
+		case now = <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		nm.Mutex.Lock()
+		for i := 1; i < 128; i++ {
+			ns := nm.getState(Node(i))
+			if ns == nil {
+				continue
+			}
+			// nodes reserved for firmware operations may stay quiet in their
+			// bootloader
+			if _, busy := nm.BusyWith(ns.Id); busy {
+				continue
+			}
+			quiet := now.Sub(ns.LastSeen)
+			switch {
+			case nm.OfflineAfter > 0 && quiet >= nm.OfflineAfter:
+				events = append(events, ns.setStatus(NODE_STATUS_OFFLINE))
+			case nm.SuspectAfter > 0 && quiet >= nm.SuspectAfter:
+				events = append(events, ns.setStatus(NODE_STATUS_SUSPECT))
+			}
+			if quiet >= nm.PingInterval && now.Sub(pinged[ns.Id]) >= nm.PingInterval {
+				pings = append(pings, ns.Id)
+				pinged[ns.Id] = now
+			}
+		}
+		nm.Mutex.Unlock()
+
+		for _, event := range events {
+			emitNodeStatus(event)
+		}
+		for _, node := range pings {
+			clog.Debug("Pinging quiet node %d", node)
+			port.SendMessage(NewSystemMessage(node, NOCAN_SYS_NODE_PING, 0, nil))
+		}
+	}
+}
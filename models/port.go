@@ -3,6 +3,7 @@ package models
 import (
 	"pannetrat.com/nocan/clog"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -11,6 +12,28 @@ const (
 	EXTENDED_TIMEOUT = 12 * time.Second
 )
 
+// Timeouts used when waiting for responses from nodes. The configuration of
+// the manager may change them while jobs are running, so they are accessed
+// atomically, see SetTimeouts.
+var (
+	defaultTimeout  int64 = int64(DEFAULT_TIMEOUT)
+	extendedTimeout int64 = int64(EXTENDED_TIMEOUT)
+)
+
+func DefaultTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&defaultTimeout))
+}
+
+// ExtendedTimeout is used for slow operations, such as rebooting a node.
+func ExtendedTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&extendedTimeout))
+}
+
+func SetTimeouts(timeout time.Duration, extended time.Duration) {
+	atomic.StoreInt64(&defaultTimeout, int64(timeout))
+	atomic.StoreInt64(&extendedTimeout, int64(extended))
+}
+
 type PortId int
 
 type Port struct {
@@ -18,6 +41,7 @@ type Port struct {
 	Name    string
 	Manager *PortManagerModel
 	Input   chan *Message
+	Filter  MessageFilter // if set, only messages accepted by the filter are delivered
 	Next    *Port
 }
 
@@ -37,7 +61,7 @@ func (port *Port) SendMessage(m *Message) {
 	//clog.Debug("Send from port %s: %s", port.Name, m.String())
 	m.Tag(port.Id)
 	for p := port.Manager.Head; p != nil; p = p.Next {
-		if p.Id != port.Id { // we could directly compare (p != port), same result.
+		if p.Id != port.Id && (p.Filter == nil || p.Filter(m)) { // we could directly compare (p != port), same result.
 			//clog.Debug("Send to port %s: %s", p.Name, m.String())
 			p.Input <- m
 		}
@@ -72,7 +96,15 @@ func NewPortManagerModel() *PortManagerModel {
 }
 
 func (pm *PortManagerModel) CreatePort(name string) *Port {
+	return pm.CreateFilteredPort(name, nil)
+}
+
+// CreateFilteredPort creates a port that only receives the messages accepted
+// by filter. The filter is set before the port is published, since it is
+// called by other ports with the PortManager mutex held.
+func (pm *PortManagerModel) CreateFilteredPort(name string, filter MessageFilter) *Port {
 	port := newPort(pm, name)
+	port.Filter = filter
 
 	pm.Mutex.Lock()
 
@@ -0,0 +1,43 @@
+package models
+
+// routeMessage decides whether a message should be sent on the bus of an
+// interface. With a single interface every message goes out, as before.
+// Otherwise:
+//   - system messages from a bus are meant for the manager and never cross
+//     over to another bus;
+//   - system messages from the manager go to the bus where the target node
+//     (or, for NOCAN_SYS_ADDRESS_CONFIGURE, the target UDID) was last seen,
+//     or to every bus if that is not known yet;
+//   - publications go to the buses that have subscribers for the channel.
+//     Publications from the manager go everywhere if no subscriber is known.
+//
+// It looks up Nodes, so it is called by processMessages rather than by a port
+// filter, which would run with the PortManager mutex held.
+func (dm *InterfaceModel) routeMessage(ds *InterfaceState, m *Message) bool {
+	if len(dm.Interfaces) < 2 {
+		return true
+	}
+
+	fromBus := dm.ByPort(m.SourcePort) != nil
+
+	if m.Id.IsSystem() {
+		if fromBus {
+			return false
+		}
+
+		var interfaceId int
+		var ok bool
+		if m.Id.GetSysFunc() == NOCAN_SYS_ADDRESS_CONFIGURE {
+			interfaceId, ok = Nodes.InterfaceOfUdid(m.Data)
+		} else {
+			interfaceId, ok = Nodes.InterfaceOf(m.Id.GetNode())
+		}
+		return !ok || interfaceId == ds.InterfaceId
+	}
+
+	subscribers := Nodes.SubscribedInterfaces(m.Id.GetChannel())
+	if len(subscribers) == 0 && !fromBus {
+		return true
+	}
+	return subscribers[ds.InterfaceId]
+}
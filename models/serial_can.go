@@ -26,20 +26,40 @@ const (
 )
 
 type SerialCan struct {
-	fd C.int
+	Device string
+	fd     C.int
+}
+
+func init() {
+	RegisterTransport("serial", func(device string) (Transport, error) {
+		return NewSerialCan(device), nil
+	})
+}
+
+func NewSerialCan(device string) *SerialCan {
+	return &SerialCan{Device: device, fd: -1}
 }
 
 func SerialCanOpen(device string) (*SerialCan, error) {
-	dev := C.CString(device)
+	sc := NewSerialCan(device)
+	if err := sc.Open(); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+func (sc *SerialCan) Open() error {
+	dev := C.CString(sc.Device)
 	defer C.free(unsafe.Pointer(dev))
 
 	fd := C.serial_can_open(dev)
 	if fd < 0 {
-		clog.Error("FAILED opening %s", device)
-		return nil, fmt.Errorf("Could not open %s", device)
+		clog.Error("FAILED opening %s", sc.Device)
+		return fmt.Errorf("Could not open %s", sc.Device)
 	}
-	clog.Debug("SUCCESS opening %s", device)
-	return &SerialCan{fd}, nil
+	clog.Debug("SUCCESS opening %s", sc.Device)
+	sc.fd = fd
+	return nil
 }
 
 func (sc *SerialCan) Close() {
@@ -0,0 +1,321 @@
+package models_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"pannetrat.com/nocan/clog"
+	"pannetrat.com/nocan/intelhex"
+	"pannetrat.com/nocan/models"
+	"pannetrat.com/nocan/simulator"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The tests of this file run the models against a simulated bus, created
+// once in TestMain and shared by all tests.
+
+const simConfig = `
+nodes:
+  - udid: "01:02:03:04:05:06:07:08"
+    channels: [test/temperature, test/led]
+    subscriptions: [test/led]
+    publish:
+      - channel: test/temperature
+        value: "21.5"
+        interval: 200ms
+  - udid: "01:02:03:04:05:06:07:09"
+    bootloader_timeout: 2s
+`
+
+var simUdid = [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+var bootUdid = [8]byte{1, 2, 3, 4, 5, 6, 7, 9}
+
+const TEST_TIMEOUT = 30 * time.Second
+
+func TestMain(m *testing.M) {
+	os.Exit(runWithSimulator(m))
+}
+
+func runWithSimulator(m *testing.M) int {
+	dir, err := ioutil.TempDir("", "nocan-test")
+	if err != nil {
+		clog.Error("Failed to create temporary directory: %s", err.Error())
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	config := filepath.Join(dir, "sim.yaml")
+	if err := ioutil.WriteFile(config, []byte(simConfig), 0644); err != nil {
+		clog.Error("Failed to write %s: %s", config, err.Error())
+		return 1
+	}
+
+	clog.SetLevel(clog.WARNING)
+	if _, err := models.Interfaces.AddInterface("sim:" + config); err != nil {
+		clog.Error("Failed to open simulated interface: %s", err.Error())
+		return 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go models.Channels.Run(ctx)
+	go models.Nodes.Run(ctx)
+	go models.Jobs.Run(ctx)
+	models.Interfaces.Run(ctx)
+
+	return m.Run()
+}
+
+// eventually calls cond until it returns true, failing the test after
+// TEST_TIMEOUT.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(TEST_TIMEOUT)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// registeredNode waits for the main simulated node to get its address.
+func registeredNode(t *testing.T) models.Node {
+	t.Helper()
+	return registeredUdid(t, simUdid)
+}
+
+func registeredUdid(t *testing.T, udid [8]byte) models.Node {
+	t.Helper()
+	var node models.Node
+	eventually(t, "node registration", func() bool {
+		var ok bool
+		node, ok = models.Nodes.ByUdid(udid)
+		return ok
+	})
+	return node
+}
+
+func simulatedBus() *simulator.Bus {
+	return models.Interfaces.GetInterface(0).Transport.(*simulator.Bus)
+}
+
+// startJob starts a node job, once the node is not busy anymore.
+func startJob(t *testing.T, operation string, node models.Node, fn func(*models.JobState)) *models.JobState {
+	t.Helper()
+	var job *models.JobState
+	eventually(t, "node reservation", func() bool {
+		id, err := models.Jobs.CreateNodeJob(operation, []models.Node{node}, fn)
+		if err != nil {
+			return false
+		}
+		job = models.Jobs.FindJob(id)
+		return true
+	})
+	return job
+}
+
+// runJob starts a node job and waits for it to finish.
+func runJob(t *testing.T, operation string, node models.Node, fn func(*models.JobState)) *models.JobState {
+	t.Helper()
+	job := startJob(t, operation, node, fn)
+	eventually(t, operation, func() bool {
+		return job.GetStatus() != models.JobStarted
+	})
+	return job
+}
+
+func testImage(size int) *intelhex.IntelHex {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*7 + 3)
+	}
+	ihex := intelhex.New()
+	ihex.Add(0, 0, data)
+	return ihex
+}
+
+func download(t *testing.T, node models.Node, memtype byte, length uint32) *intelhex.IntelHex {
+	t.Helper()
+	job := runJob(t, "flash download", node, func(state *models.JobState) {
+		models.Nodes.DownloadFirmware(state, node, memtype, length)
+	})
+	if job.GetStatus() != models.JobCompleted {
+		t.Fatalf("Download failed: %v", job.Info().Error)
+	}
+	result, _ := job.GetResult()
+	ihex := intelhex.New()
+	if err := ihex.Load(bytes.NewReader(result)); err != nil {
+		t.Fatalf("Download returned invalid Intel HEX: %s", err.Error())
+	}
+	return ihex
+}
+
+func TestRegistration(t *testing.T) {
+	node := registeredNode(t)
+	if node < 1 || node > 127 {
+		t.Fatalf("Node got invalid address %d", node)
+	}
+	if n, ok := models.Nodes.Lookup(simUdid[:]); !ok || n != node {
+		t.Errorf("Lookup returned %d, %v, expected %d", n, ok, node)
+	}
+	if props := models.Nodes.GetProperties(node); props == nil || props.Udid != models.UdidToString(simUdid[:]) {
+		t.Errorf("Unexpected node properties %+v", props)
+	}
+}
+
+func TestPing(t *testing.T) {
+	node := registeredNode(t)
+	if err := models.Nodes.DoPing(node); err != nil {
+		t.Fatal(err)
+	}
+	if err := models.Nodes.DoPing(127); err == nil {
+		t.Errorf("Ping of missing node 127 succeeded")
+	}
+}
+
+func TestUploadReadBack(t *testing.T) {
+	node := registeredNode(t)
+	image := testImage(600) // spans several pages, the last one partial
+
+	models.Nodes.SetFirmware(node, "previous@1.0")
+	job := runJob(t, "flash upload", node, func(state *models.JobState) {
+		models.Nodes.UploadFirmware(state, node, 'F', image, false, "")
+	})
+	if job.GetStatus() != models.JobCompleted {
+		t.Fatalf("Upload failed: %v", job.Info().Error)
+	}
+	if firmware := models.Nodes.GetProperties(node).Firmware; firmware != "" {
+		t.Errorf("Node still records firmware %s after a different image was uploaded", firmware)
+	}
+
+	memory := download(t, node, 'F', 1024)
+	expected := image.Blocks[0].Data
+	actual := memory.Blocks[0].Data
+	if len(memory.Blocks) != 1 || len(actual) != 1024 {
+		t.Fatalf("Unexpected download layout: %d blocks", len(memory.Blocks))
+	}
+	if !bytes.Equal(actual[:len(expected)], expected) {
+		t.Errorf("Flash content does not match the uploaded image")
+	}
+	for i := len(expected); i < len(actual); i++ {
+		if actual[i] != 0xFF {
+			t.Fatalf("Flash at 0x%x was modified: 0x%02x", i, actual[i])
+		}
+	}
+}
+
+func TestDownload(t *testing.T) {
+	node := registeredNode(t)
+
+	memory := download(t, node, 'E', 256)
+	if len(memory.Blocks) != 1 || memory.Blocks[0].Address != 0 || len(memory.Blocks[0].Data) != 256 {
+		t.Fatalf("Unexpected download layout")
+	}
+	for i, b := range memory.Blocks[0].Data {
+		if b != 0xFF {
+			t.Fatalf("Erased eeprom at 0x%x is 0x%02x", i, b)
+		}
+	}
+
+	job := runJob(t, "flash download", node, func(state *models.JobState) {
+		models.Nodes.DownloadFirmware(state, node, 'F', 0x10000)
+	})
+	if job.GetStatus() != models.JobFailed {
+		t.Errorf("Download beyond the flash size did not fail")
+	}
+}
+
+func TestDownloadCancellation(t *testing.T) {
+	node := registeredNode(t)
+
+	job := startJob(t, "flash download", node, func(state *models.JobState) {
+		models.Nodes.DownloadFirmware(state, node, 'F', 0x7000)
+	})
+	eventually(t, "download progress", func() bool {
+		return job.GetProgress() > 0 || job.GetStatus() != models.JobStarted
+	})
+	if !models.Jobs.CancelJob(job.Id) {
+		t.Fatalf("Job %d could not be cancelled: %+v", job.Id, job.Info())
+	}
+	eventually(t, "cancellation", func() bool {
+		return job.GetStatus() != models.JobStarted
+	})
+	if job.GetStatus() != models.JobCancelled {
+		t.Fatalf("Job ended as %s", models.JobStatusName(job.GetStatus()))
+	}
+	if result, _ := job.GetResult(); result != nil {
+		t.Errorf("Cancelled job has a result")
+	}
+	// the node must have left its bootloader, where it would not answer pings
+	if err := models.Nodes.DoPing(node); err != nil {
+		t.Errorf("Node did not return to its application: %s", err.Error())
+	}
+}
+
+func TestChannelUpdate(t *testing.T) {
+	node := registeredNode(t)
+
+	var temperature models.Channel
+	eventually(t, "channel registration", func() bool {
+		var ok bool
+		temperature, ok = models.Channels.Lookup("test/temperature")
+		return ok
+	})
+	// a fresh update also shows that the node is running again, if an
+	// earlier test restarted it
+	start := time.Now()
+	eventually(t, "channel update", func() bool {
+		state, ok := models.Channels.GetState(temperature)
+		return ok && state.UpdatedAt.After(start)
+	})
+	if content, _ := models.Channels.GetContent(temperature); string(content) != "21.5" {
+		t.Errorf("Channel test/temperature holds %q", content)
+	}
+	if state, ok := models.Channels.GetState(temperature); !ok || state.Owner != node {
+		t.Errorf("Channel is not owned by node %d: %+v", node, state)
+	}
+
+	led, ok := models.Channels.Lookup("test/led")
+	if !ok {
+		t.Fatal("Channel test/led was not registered")
+	}
+	eventually(t, "subscription", func() bool {
+		return len(models.Nodes.SubscribedInterfaces(led)) > 0
+	})
+	if err := models.Channels.PublishValue(led, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := models.Channels.GetContent(led); string(content) != "1" {
+		t.Errorf("Channel test/led holds %q after publishing", content)
+	}
+	eventually(t, "value delivery", func() bool {
+		value, ok := simulatedBus().ReceivedValue(simUdid, "test/led")
+		return ok && string(value) == "1"
+	})
+}
+
+func TestBootloaderTimeout(t *testing.T) {
+	node := registeredUdid(t, bootUdid)
+	eventually(t, "node startup", func() bool {
+		return models.Nodes.DoPing(node) == nil
+	})
+
+	// a node left in its bootloader, as after a failed job, does not answer
+	// pings until its bootloader times out
+	port := models.PortManager.CreateFilteredPort("bootloader-test", func(*models.Message) bool { return false })
+	defer models.PortManager.DestroyPort(port)
+	port.SendMessage(models.NewSystemMessage(node, models.NOCAN_SYS_NODE_BOOT_REQUEST, 0x01, nil))
+	if err := models.Nodes.DoPing(node); err == nil {
+		t.Fatalf("Node %d answered a ping in its bootloader", node)
+	}
+	eventually(t, "bootloader timeout", func() bool {
+		return models.Nodes.DoPing(node) == nil
+	})
+	if n, _ := models.Nodes.ByUdid(bootUdid); n != node {
+		t.Errorf("Node restarted as %d, expected %d", n, node)
+	}
+}
@@ -0,0 +1,12 @@
+#ifndef _SOCKET_CAN_H_
+#define _SOCKET_CAN_H_
+
+int socket_can_open(const char *ifname);
+
+int socket_can_send(int fd, unsigned int can_id, unsigned char can_dlc, const unsigned char *data);
+
+int socket_can_recv(int fd, unsigned int *can_id, unsigned char *can_dlc, unsigned char *data);
+
+void socket_can_close(int fd);
+
+#endif
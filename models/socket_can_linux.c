@@ -0,0 +1,76 @@
+#include "socket_can.h"
+#include <sys/types.h>
+#include <sys/socket.h>
+#include <sys/ioctl.h>
+#include <net/if.h>
+#include <linux/can.h>
+#include <linux/can/raw.h>
+#include <stdio.h>
+#include <string.h>
+#include <unistd.h>
+#include <errno.h>
+
+int socket_can_open(const char *ifname)
+{
+    int fd;
+    struct ifreq ifr;
+    struct sockaddr_can addr;
+    can_err_mask_t err_mask = CAN_ERR_MASK;
+
+    fd = socket(PF_CAN, SOCK_RAW, CAN_RAW);
+    if (fd < 0) {
+        fprintf(stderr, "Could not create CAN socket: %s\n", strerror(errno));
+        return -1;
+    }
+
+    memset(&ifr, 0, sizeof(ifr));
+    strncpy(ifr.ifr_name, ifname, IFNAMSIZ - 1);
+    if (ioctl(fd, SIOCGIFINDEX, &ifr) < 0) {
+        fprintf(stderr, "Could not find CAN interface %s: %s\n", ifname, strerror(errno));
+        close(fd);
+        return -1;
+    }
+
+    /* report controller errors as error frames */
+    setsockopt(fd, SOL_CAN_RAW, CAN_RAW_ERR_FILTER, &err_mask, sizeof(err_mask));
+
+    memset(&addr, 0, sizeof(addr));
+    addr.can_family = AF_CAN;
+    addr.can_ifindex = ifr.ifr_ifindex;
+    if (bind(fd, (struct sockaddr *)&addr, sizeof(addr)) < 0) {
+        fprintf(stderr, "Could not bind to CAN interface %s: %s\n", ifname, strerror(errno));
+        close(fd);
+        return -1;
+    }
+    return fd;
+}
+
+int socket_can_send(int fd, unsigned int can_id, unsigned char can_dlc, const unsigned char *data)
+{
+    struct can_frame frame;
+
+    if (can_dlc > 8)
+        return 0;
+    memset(&frame, 0, sizeof(frame));
+    frame.can_id = can_id;
+    frame.can_dlc = can_dlc;
+    memcpy(frame.data, data, can_dlc);
+    return write(fd, &frame, sizeof(frame)) == sizeof(frame);
+}
+
+int socket_can_recv(int fd, unsigned int *can_id, unsigned char *can_dlc, unsigned char *data)
+{
+    struct can_frame frame;
+
+    if (read(fd, &frame, sizeof(frame)) != sizeof(frame))
+        return 0;
+    *can_id = frame.can_id;
+    *can_dlc = frame.can_dlc > 8 ? 8 : frame.can_dlc;
+    memcpy(data, frame.data, 8);
+    return 1;
+}
+
+void socket_can_close(int fd)
+{
+    close(fd);
+}
@@ -0,0 +1,171 @@
+package models
+
+/*
+#include "socket_can.h"
+#include <stdlib.h>
+*/
+import "C"
+import "unsafe"
+import "fmt"
+import "io"
+import "sync"
+
+import "pannetrat.com/nocan/clog"
+
+// SocketCan is a Transport for CAN controllers handled natively by the Linux
+// kernel (e.g. can0 or the vcan virtual driver). It translates serial packets
+// into kernel can_frames and answers interface commands itself, since there
+// is no serial adapter to send them to.
+type SocketCan struct {
+	Mutex      sync.Mutex // protects fd, closed and generation
+	Device     string
+	fd         C.int
+	closed     bool
+	generation int
+	input      chan socketCanInput
+}
+
+// socketCanInput is a packet for Read, or a read failure if packet is nil.
+// Failures of sockets replaced by Open since then are ignored.
+type socketCanInput struct {
+	generation int
+	packet     []byte
+}
+
+func init() {
+	RegisterTransport("socketcan", func(device string) (Transport, error) {
+		return NewSocketCan(device), nil
+	})
+}
+
+func NewSocketCan(device string) *SocketCan {
+	return &SocketCan{Device: device, fd: -1, input: make(chan socketCanInput, 16)}
+}
+
+func (sc *SocketCan) Open() error {
+	dev := C.CString(sc.Device)
+	defer C.free(unsafe.Pointer(dev))
+
+	fd := C.socket_can_open(dev)
+	if fd < 0 {
+		clog.Error("FAILED opening CAN interface %s", sc.Device)
+		return fmt.Errorf("Could not open CAN interface %s", sc.Device)
+	}
+	clog.Debug("SUCCESS opening CAN interface %s", sc.Device)
+	sc.Mutex.Lock()
+	if sc.fd >= 0 {
+		// reopened without being closed first, e.g. by a rescue
+		C.socket_can_close(sc.fd)
+	}
+	sc.fd = fd
+	sc.closed = false
+	sc.generation++
+	generation := sc.generation
+	sc.Mutex.Unlock()
+	go sc.receive(fd, generation)
+	return nil
+}
+
+func (sc *SocketCan) Close() {
+	clog.Debug("Closing CAN interface %s", sc.Device)
+	sc.Mutex.Lock()
+	defer sc.Mutex.Unlock()
+
+	if sc.fd >= 0 {
+		C.socket_can_close(sc.fd)
+	}
+	sc.fd = -1
+	sc.closed = true
+}
+
+func (sc *SocketCan) getFd() (C.int, bool) {
+	sc.Mutex.Lock()
+	defer sc.Mutex.Unlock()
+	return sc.fd, sc.closed
+}
+
+func (sc *SocketCan) receive(fd C.int, generation int) {
+	var canId C.uint
+	var canDlc C.uchar
+	var data [8]C.uchar
+
+	for {
+		if C.socket_can_recv(fd, &canId, &canDlc, &data[0]) == 0 {
+			// Read() reports the failure, which will trigger a Rescue()
+			sc.input <- socketCanInput{generation, nil}
+			return
+		}
+		frame := CanFrame{CanId: CanId(canId), CanDlc: uint8(canDlc)}
+		for i := 0; i < 8; i++ {
+			frame.CanData[i] = uint8(data[i])
+		}
+		packet, _ := frame.MarshalBinary()
+		sc.input <- socketCanInput{generation, packet}
+	}
+}
+
+func (sc *SocketCan) respond(header byte) {
+	sc.Mutex.Lock()
+	generation := sc.generation
+	sc.Mutex.Unlock()
+	sc.input <- socketCanInput{generation, []byte{header}}
+}
+
+func (sc *SocketCan) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, fmt.Errorf("CAN write: frame is empty")
+	}
+
+	switch p[0] {
+	case SERIAL_HEADER_PACKET:
+		var frame CanFrame
+		var data [8]C.uchar
+
+		if err := frame.UnmarshalBinary(p); err != nil {
+			return 0, err
+		}
+		for i := 0; i < 8; i++ {
+			data[i] = C.uchar(frame.CanData[i])
+		}
+		fd, _ := sc.getFd()
+		if fd < 0 || C.socket_can_send(fd, C.uint(frame.CanId), C.uchar(frame.CanDlc), &data[0]) == 0 {
+			clog.Debug("FAILED Sending CAN frame %s", frame.String())
+			sc.respond(SERIAL_HEADER_FAIL)
+		} else {
+			sc.respond(SERIAL_HEADER_SUCCESS)
+		}
+	case SERIAL_HEADER_REQUEST_SOFT_RESET, SERIAL_HEADER_REQUEST_HARD_RESET, SERIAL_HEADER_VERSION:
+		sc.respond(SERIAL_HEADER_SUCCESS)
+	default:
+		// Power and termination resistor controls only exist on the serial adapter
+		sc.respond(SERIAL_HEADER_COMMAND_UNKNOWN)
+	}
+	return len(p), nil
+}
+
+// Read returns io.EOF once the transport has been closed.
+func (sc *SocketCan) Read(p []byte) (int, error) {
+	if _, closed := sc.getFd(); closed {
+		return 0, io.EOF
+	}
+	for {
+		input := <-sc.input
+		if input.packet != nil {
+			return copy(p, input.packet), nil
+		}
+		sc.Mutex.Lock()
+		closed, stale := sc.closed, input.generation != sc.generation
+		sc.Mutex.Unlock()
+		if closed {
+			return 0, io.EOF
+		}
+		if !stale {
+			return 0, fmt.Errorf("CAN read: failed on %s", sc.Device)
+		}
+	}
+}
+
+func (sc *SocketCan) Status() (int, bool) {
+	fd, _ := sc.getFd()
+	return 0, fd >= 0
+}
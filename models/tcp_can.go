@@ -0,0 +1,294 @@
+package models
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"pannetrat.com/nocan/clog"
+	"sync"
+	"time"
+)
+
+const (
+	TCP_RECONNECT_MIN_DELAY = 1 * time.Second
+	TCP_RECONNECT_MAX_DELAY = 30 * time.Second
+)
+
+func init() {
+	RegisterTransport("tcp", func(address string) (Transport, error) {
+		return NewTcpCan(address), nil
+	})
+}
+
+// readPacket reads a single serial packet from a stream: a header byte whose
+// low nibble is the number of bytes that follow.
+func readPacket(r io.Reader) ([]byte, error) {
+	packet := make([]byte, 16)
+	if _, err := io.ReadFull(r, packet[:1]); err != nil {
+		return nil, err
+	}
+	plen := 1 + int(packet[0]&0xF)
+	if _, err := io.ReadFull(r, packet[1:plen]); err != nil {
+		return nil, err
+	}
+	return packet[:plen], nil
+}
+
+func writePacket(w io.Writer, p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, fmt.Errorf("Packet write: frame is empty")
+	}
+	plen := 1 + int(p[0]&0xF)
+	if len(p) < plen {
+		return 0, fmt.Errorf("Packet write: frame is too short (%d<%d)", len(p), plen)
+	}
+	return w.Write(p[:plen])
+}
+
+// TcpCan is a Transport connected to a remote interface exported by
+// ServeTransport (e.g. --interface tcp://pi-kitchen:7070). It reconnects
+// automatically in the background: while disconnected, writes fail
+// immediately and reads simply wait for the link to come back, until Close.
+type TcpCan struct {
+	Address     string
+	Mutex       sync.Mutex
+	conn        net.Conn
+	input       chan []byte
+	done        chan struct{} // closed by Close
+	running     bool
+	closing     bool
+	onReconnect func()
+}
+
+func NewTcpCan(address string) *TcpCan {
+	return &TcpCan{Address: address, input: make(chan []byte, 16), done: make(chan struct{})}
+}
+
+func (tc *TcpCan) Open() error {
+	tc.Mutex.Lock()
+	defer tc.Mutex.Unlock()
+
+	if tc.closing {
+		tc.closing = false
+		tc.done = make(chan struct{})
+	}
+	if !tc.running {
+		// Try to connect right away, but keep trying in the background if the
+		// remote interface is not reachable yet.
+		conn, err := net.DialTimeout("tcp", tc.Address, DefaultTimeout())
+		if err != nil {
+			clog.Warning("Failed to connect to %s: %s", tc.Address, err.Error())
+		} else {
+			clog.Info("Connected to interface at %s", tc.Address)
+			tc.conn = conn
+		}
+		tc.running = true
+		go tc.run(conn)
+	}
+	return nil
+}
+
+func (tc *TcpCan) Close() {
+	tc.Mutex.Lock()
+	defer tc.Mutex.Unlock()
+
+	clog.Debug("Closing connection to %s", tc.Address)
+	if !tc.closing {
+		tc.closing = true
+		close(tc.done)
+	}
+	if tc.conn != nil {
+		tc.conn.Close()
+	}
+}
+
+// OnReconnect sets a function called whenever the connection is established
+// in the background, i.e. not by Open.
+func (tc *TcpCan) OnReconnect(fn func()) {
+	tc.Mutex.Lock()
+	defer tc.Mutex.Unlock()
+
+	tc.onReconnect = fn
+}
+
+func (tc *TcpCan) setConn(conn net.Conn) bool {
+	tc.Mutex.Lock()
+	defer tc.Mutex.Unlock()
+
+	if tc.closing {
+		tc.running = false
+		return false
+	}
+	tc.conn = conn
+	return true
+}
+
+func (tc *TcpCan) run(conn net.Conn) {
+	var err error
+
+	delay := TCP_RECONNECT_MIN_DELAY
+
+	for {
+		reconnected := conn == nil
+		if reconnected {
+			conn, err = net.DialTimeout("tcp", tc.Address, DefaultTimeout())
+		}
+		if err != nil {
+			clog.Warning("Failed to connect to %s: %s, retrying in %s", tc.Address, err.Error(), delay)
+			time.Sleep(delay)
+			if delay *= 2; delay > TCP_RECONNECT_MAX_DELAY {
+				delay = TCP_RECONNECT_MAX_DELAY
+			}
+			if !tc.setConn(nil) {
+				return
+			}
+			continue
+		}
+		if !tc.setConn(conn) {
+			conn.Close()
+			return
+		}
+		delay = TCP_RECONNECT_MIN_DELAY
+		tc.Mutex.Lock()
+		fn, done := tc.onReconnect, tc.done
+		tc.Mutex.Unlock()
+		if reconnected {
+			clog.Info("Reconnected to interface at %s", tc.Address)
+			if fn != nil {
+				fn()
+			}
+		}
+
+	forward:
+		for {
+			packet, err := readPacket(conn)
+			if err != nil {
+				clog.Warning("Lost connection to %s: %s", tc.Address, err.Error())
+				break
+			}
+			select {
+			case tc.input <- packet:
+			case <-done:
+				break forward
+			}
+		}
+		conn.Close()
+		conn = nil
+		if !tc.setConn(nil) {
+			return
+		}
+	}
+}
+
+func (tc *TcpCan) Write(p []byte) (int, error) {
+	tc.Mutex.Lock()
+	conn := tc.conn
+	tc.Mutex.Unlock()
+
+	if conn == nil {
+		return 0, InterfaceDisconnectedError
+	}
+	// the connection may stall without being closed, so writes cannot block
+	// forever
+	conn.SetWriteDeadline(time.Now().Add(DefaultTimeout()))
+	n, err := writePacket(conn, p)
+	if err != nil {
+		clog.Debug("FAILED Sending packet [%s] to %s", hex.EncodeToString(p), tc.Address)
+		return n, err
+	}
+	return n, nil
+}
+
+// Read returns io.EOF once the transport has been closed.
+func (tc *TcpCan) Read(p []byte) (int, error) {
+	tc.Mutex.Lock()
+	done := tc.done
+	tc.Mutex.Unlock()
+
+	select {
+	case packet := <-tc.input:
+		return copy(p, packet), nil
+	case <-done:
+		return 0, io.EOF
+	}
+}
+
+func (tc *TcpCan) Status() (int, bool) {
+	tc.Mutex.Lock()
+	defer tc.Mutex.Unlock()
+
+	return 0, tc.conn != nil
+}
+
+// ServeTransport exports a local transport over TCP so that a remote manager
+// can use it with a tcp:// interface. Only one client is served at a time: a
+// new connection replaces the previous one.
+func ServeTransport(address string, transport Transport) error {
+	var mutex sync.Mutex
+	var client net.Conn
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	clog.Info("Serving interface on %s", address)
+
+	go func() {
+		for {
+			packet := make([]byte, 16)
+			n, err := transport.Read(packet)
+			if err != nil {
+				clog.Error("Failed to read from interface: %s", err.Error())
+				transport.Close()
+				for transport.Open() != nil {
+					time.Sleep(10 * time.Second)
+				}
+				continue
+			}
+			mutex.Lock()
+			if client != nil {
+				if _, err = writePacket(client, packet[:n]); err != nil {
+					clog.Warning("Failed to forward packet to %s: %s", client.RemoteAddr(), err.Error())
+				}
+			}
+			mutex.Unlock()
+		}
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		clog.Info("Accepted interface client %s", conn.RemoteAddr())
+
+		mutex.Lock()
+		if client != nil {
+			clog.Warning("Replacing interface client %s with %s", client.RemoteAddr(), conn.RemoteAddr())
+			client.Close()
+		}
+		client = conn
+		mutex.Unlock()
+
+		go func(conn net.Conn) {
+			for {
+				packet, err := readPacket(conn)
+				if err != nil {
+					clog.Info("Interface client %s disconnected: %s", conn.RemoteAddr(), err.Error())
+					break
+				}
+				if _, err = transport.Write(packet); err != nil {
+					clog.Warning("Failed to write packet from %s: %s", conn.RemoteAddr(), err.Error())
+				}
+			}
+			mutex.Lock()
+			if client == conn {
+				client = nil
+			}
+			mutex.Unlock()
+			conn.Close()
+		}(conn)
+	}
+}
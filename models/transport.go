@@ -0,0 +1,87 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Transport carries serial interface packets between an InterfaceState and
+// the device that drives the CAN bus. A packet starts with a SERIAL_HEADER_*
+// byte whose low nibble gives the number of bytes that follow, so a packet is
+// at most 16 bytes long.
+type Transport interface {
+	// Open (re)opens the underlying device.
+	Open() error
+	// Read blocks until a full packet is available and copies it in p.
+	Read(p []byte) (int, error)
+	// Write sends a single packet.
+	Write(p []byte) (int, error)
+	Close()
+	Status() (int, bool)
+}
+
+// ReconnectingTransport is implemented by transports that restore a lost
+// link on their own, without Read failing, such as TcpCan. The function given
+// to OnReconnect is called each time the link comes back, so that the
+// interface can be reset as it would be after Rescue. It must not block.
+type ReconnectingTransport interface {
+	Transport
+	OnReconnect(fn func())
+}
+
+// TransportFactory creates a Transport from the address part of an interface
+// URI (e.g. "/dev/ttyUSB0" in "serial:///dev/ttyUSB0").
+type TransportFactory func(address string) (Transport, error)
+
+const DEFAULT_TRANSPORT_SCHEME = "serial"
+
+var (
+	transportMutex     sync.RWMutex
+	transportFactories = make(map[string]TransportFactory)
+)
+
+// RegisterTransport makes a transport available under the given URI scheme.
+func RegisterTransport(scheme string, factory TransportFactory) {
+	transportMutex.Lock()
+	defer transportMutex.Unlock()
+
+	transportFactories[scheme] = factory
+}
+
+// ParseTransportURI splits an interface URI into a scheme and an address.
+// Strings without a registered scheme, such as "/dev/ttyUSB0", are treated
+// as serial devices.
+func ParseTransportURI(uri string) (string, string) {
+	transportMutex.RLock()
+	defer transportMutex.RUnlock()
+
+	if pos := strings.Index(uri, ":"); pos > 0 {
+		scheme := uri[:pos]
+		if _, ok := transportFactories[scheme]; ok {
+			return scheme, strings.TrimPrefix(uri[pos+1:], "//")
+		}
+	}
+	return DEFAULT_TRANSPORT_SCHEME, uri
+}
+
+// OpenTransport selects a transport by URI scheme and opens it.
+func OpenTransport(uri string) (Transport, error) {
+	scheme, address := ParseTransportURI(uri)
+
+	transportMutex.RLock()
+	factory, ok := transportFactories[scheme]
+	transportMutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Unsupported interface type '%s' in %s", scheme, uri)
+	}
+	transport, err := factory(address)
+	if err != nil {
+		return nil, err
+	}
+	if err = transport.Open(); err != nil {
+		return nil, err
+	}
+	return transport, nil
+}
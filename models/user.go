@@ -0,0 +1,226 @@
+package models
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Verified credentials are remembered for a while, since checking a bcrypt
+// hash on every request would be slow on small boards.
+const USER_CACHE_DURATION = 5 * time.Minute
+
+type Role int
+
+const (
+	ROLE_NONE Role = iota
+	ROLE_READONLY
+	ROLE_OPERATOR
+	ROLE_ADMIN
+)
+
+var roleNames = [...]string{"none", "readonly", "operator", "admin"}
+
+func (role Role) String() string {
+	if role < 0 || int(role) >= len(roleNames) {
+		return "unknown"
+	}
+	return roleNames[role]
+}
+
+func ParseRole(s string) (Role, error) {
+	for i, name := range roleNames {
+		if i > 0 && s == name {
+			return Role(i), nil
+		}
+	}
+	if s == "read-only" {
+		return ROLE_READONLY, nil
+	}
+	return ROLE_NONE, fmt.Errorf("Unknown role '%s', expected readonly, operator or admin", s)
+}
+
+type User struct {
+	Name string
+	Role Role
+	hash []byte
+}
+
+// UserModel holds the users allowed to access the API, read from a file with
+// one "name:role:hash" line per user, where hash is the bcrypt hash of the
+// secret of the user. API tokens are given on "token:id:role:hash" lines,
+// and are presented as "id.secret" (see NewToken), so that each one can be
+// revoked by removing its line. Access is not restricted until a file is
+// loaded.
+type UserModel struct {
+	Mutex    sync.RWMutex
+	UserFile string
+	Users    map[string]*User
+	Tokens   map[string]*User // by token id
+	verified map[[sha256.Size]byte]time.Time
+}
+
+func NewUserModel() *UserModel {
+	return &UserModel{Users: make(map[string]*User), Tokens: make(map[string]*User), verified: make(map[[sha256.Size]byte]time.Time)}
+}
+
+func (um *UserModel) LoadFromFile(userfile string) error {
+	users := make(map[string]*User)
+	tokens := make(map[string]*User)
+
+	file, err := os.Open(userfile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// bcrypt hashes never contain ':'
+		fields := strings.Split(line, ":")
+		entries, kind := users, "user"
+		if len(fields) == 4 && fields[0] == "token" {
+			fields = fields[1:]
+			entries, kind = tokens, "token"
+		}
+		if len(fields) != 3 || fields[0] == "" || fields[2] == "" {
+			return fmt.Errorf("Line %d of %s is not of the form name:role:hash or token:id:role:hash", lineno, userfile)
+		}
+		role, err := ParseRole(fields[1])
+		if err != nil {
+			return fmt.Errorf("Line %d of %s: %s", lineno, userfile, err.Error())
+		}
+		if _, ok := entries[fields[0]]; ok {
+			return fmt.Errorf("Line %d of %s: %s %s appears twice", lineno, userfile, kind, fields[0])
+		}
+		entries[fields[0]] = &User{Name: fields[0], Role: role, hash: []byte(fields[2])}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	um.Mutex.Lock()
+	defer um.Mutex.Unlock()
+
+	um.UserFile = userfile
+	um.Users = users
+	um.Tokens = tokens
+	um.verified = make(map[[sha256.Size]byte]time.Time)
+	return nil
+}
+
+// Enabled tells whether API access is restricted to known users.
+func (um *UserModel) Enabled() bool {
+	um.Mutex.RLock()
+	defer um.Mutex.RUnlock()
+	return um.UserFile != ""
+}
+
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// unknownHash returns a hash that no secret matches, which is checked for
+// unknown users so that they take as long to refuse as wrong secrets.
+func unknownHash() []byte {
+	dummyHashOnce.Do(func() {
+		var secret [16]byte
+		rand.Read(secret[:])
+		dummyHash, _ = bcrypt.GenerateFromPassword(secret[:], bcrypt.DefaultCost)
+	})
+	return dummyHash
+}
+
+// Authenticate returns the user with the given name if secret matches its
+// hash.
+func (um *UserModel) Authenticate(name string, secret string) (User, bool) {
+	um.Mutex.RLock()
+	user := um.Users[name]
+	um.Mutex.RUnlock()
+	return um.verify("user", user, secret)
+}
+
+// AuthenticateToken returns the user of an API token, given as "id.secret".
+func (um *UserModel) AuthenticateToken(token string) (User, bool) {
+	var user *User
+
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) == 2 {
+		um.Mutex.RLock()
+		user = um.Tokens[parts[0]]
+		um.Mutex.RUnlock()
+	} else {
+		parts = append(parts, "")
+	}
+	return um.verify("token", user, parts[1])
+}
+
+func (um *UserModel) verify(kind string, user *User, secret string) (User, bool) {
+	if user == nil {
+		bcrypt.CompareHashAndPassword(unknownHash(), []byte(secret))
+		return User{}, false
+	}
+
+	key := sha256.Sum256([]byte(kind + "\x00" + user.Name + "\x00" + secret + "\x00" + string(user.hash)))
+	um.Mutex.RLock()
+	verifiedAt, ok := um.verified[key]
+	um.Mutex.RUnlock()
+	if ok && time.Since(verifiedAt) < USER_CACHE_DURATION {
+		return *user, true
+	}
+
+	if bcrypt.CompareHashAndPassword(user.hash, []byte(secret)) != nil {
+		return User{}, false
+	}
+
+	um.Mutex.Lock()
+	now := time.Now()
+	for k, t := range um.verified {
+		if now.Sub(t) >= USER_CACHE_DURATION {
+			delete(um.verified, k)
+		}
+	}
+	um.verified[key] = now
+	um.Mutex.Unlock()
+	return *user, true
+}
+
+// NewToken creates a random API token with the given id. It returns the
+// token to give to the client and the line to add to the user file.
+func NewToken(id string, role Role) (string, string, error) {
+	var secret [24]byte
+
+	if id == "" || strings.ContainsAny(id, ":.") {
+		return "", "", fmt.Errorf("Token id '%s' must not be empty or contain ':' or '.'", id)
+	}
+	if _, err := rand.Read(secret[:]); err != nil {
+		return "", "", err
+	}
+	token := hex.EncodeToString(secret[:])
+	hash, err := HashSecret(token)
+	if err != nil {
+		return "", "", err
+	}
+	return id + "." + token, "token:" + id + ":" + role.String() + ":" + hash, nil
+}
+
+// HashSecret returns the hash of a secret, as written in the user file.
+func HashSecret(secret string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
@@ -0,0 +1,231 @@
+package nocan
+
+import (
+	"context"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"pannetrat.com/nocan/clog"
+	"pannetrat.com/nocan/controllers"
+	"pannetrat.com/nocan/models"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MQTT_SUBSCRIBE_INTERVAL is how often the task looks for channels created
+// through the API, which it needs to subscribe to.
+const MQTT_SUBSCRIBE_INTERVAL = 10 * time.Second
+
+// MQTT_DISCONNECT_QUIESCE is how long pending MQTT work may take to complete
+// when the task stops, in milliseconds.
+const MQTT_DISCONNECT_QUIESCE = 250
+
+type MqttOptions struct {
+	Broker   string
+	ClientId string
+	Username string
+	Password string
+	Prefix   string
+	Qos      byte
+	Retain   bool
+	Channels []string // MQTT-style filters ('+' and '#' wildcards), all channels if empty
+}
+
+// MqttTask bridges NoCAN channels and an MQTT broker: channel updates are
+// published to <prefix>/<channel>, and messages sent to <prefix>/<channel>/set
+// are published on the bus. The task only subscribes to the exact /set topics
+// of the bridged channels, so that it does not receive its own updates.
+type MqttTask struct {
+	Port       *models.Port
+	Client     mqtt.Client
+	Options    MqttOptions
+	Mutex      sync.Mutex
+	subscribed map[string]bool // channel names
+}
+
+func NewMqttTask(app *controllers.Application, options MqttOptions) (*MqttTask, error) {
+	task := &MqttTask{Options: options, subscribed: make(map[string]bool)}
+	task.Options.Prefix = strings.TrimSuffix(options.Prefix, "/")
+
+	if options.Qos > 2 {
+		return nil, fmt.Errorf("MQTT QoS must be 0, 1 or 2, got %d", options.Qos)
+	}
+
+	opts := mqtt.NewClientOptions().AddBroker(options.Broker).SetClientID(options.ClientId).SetAutoReconnect(true)
+	if options.Username != "" {
+		opts.SetUsername(options.Username).SetPassword(options.Password)
+	}
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		// (re)subscribe after each connection, since the session may have been lost
+		clog.Info("MQTT: Connected to %s", task.Options.Broker)
+		task.Mutex.Lock()
+		task.subscribed = make(map[string]bool)
+		task.Mutex.Unlock()
+		task.subscribeChannels()
+	})
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		clog.Warning("MQTT: Lost connection to %s: %s", task.Options.Broker, err.Error())
+	})
+
+	task.Client = mqtt.NewClient(opts)
+	if token := task.Client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, fmt.Errorf("MQTT: Failed to connect to %s: %s", options.Broker, token.Error().Error())
+	}
+
+	// channel registrations are followed so that writes to new channels are
+	// received right away
+	task.Port = models.PortManager.CreateFilteredPort("mqtt", func(m *models.Message) bool {
+		return m.Id.IsPublish() || (m.Id.IsSystem() && m.Id.GetSysFunc() == models.NOCAN_SYS_CHANNEL_REGISTER_ACK)
+	})
+	return task, nil
+}
+
+func (mt *MqttTask) setTopic(name string) string {
+	return mt.Options.Prefix + "/" + name + "/set"
+}
+
+// subscribeChannels subscribes to the /set topic of the bridged channels that
+// are not subscribed yet.
+func (mt *MqttTask) subscribeChannels() {
+	var names []string
+
+	mt.Mutex.Lock()
+	models.Channels.Each(func(_ models.Channel, state *models.ChannelState) {
+		if !mt.subscribed[state.Name] && mt.isBridged(state.Name) {
+			mt.subscribed[state.Name] = true
+			names = append(names, state.Name)
+		}
+	})
+	mt.Mutex.Unlock()
+
+	for _, name := range names {
+		name := name
+		topic := mt.setTopic(name)
+		token := mt.Client.Subscribe(topic, mt.Options.Qos, mt.setHandler)
+		go func() {
+			if token.Wait() && token.Error() != nil {
+				clog.Error("MQTT: Failed to subscribe to %s: %s", topic, token.Error().Error())
+				mt.Mutex.Lock()
+				delete(mt.subscribed, name)
+				mt.Mutex.Unlock()
+			} else {
+				clog.Debug("MQTT: Subscribed to %s", topic)
+			}
+		}()
+	}
+}
+
+// matchTopicFilter checks a channel name against an MQTT-style filter.
+func matchTopicFilter(filter string, name string) bool {
+	flevels := strings.Split(filter, "/")
+	nlevels := strings.Split(name, "/")
+
+	for i, level := range flevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(nlevels) {
+			return false
+		}
+		if level != "+" && level != nlevels[i] {
+			return false
+		}
+	}
+	return len(flevels) == len(nlevels)
+}
+
+func (mt *MqttTask) isBridged(name string) bool {
+	if len(mt.Options.Channels) == 0 {
+		return true
+	}
+	for _, filter := range mt.Options.Channels {
+		if matchTopicFilter(filter, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (mt *MqttTask) setHandler(client mqtt.Client, msg mqtt.Message) {
+	topic := msg.Topic()
+
+	if !strings.HasSuffix(topic, "/set") {
+		return
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(topic, mt.Options.Prefix+"/"), "/set")
+	if !mt.isBridged(name) {
+		clog.Warning("MQTT: Ignoring write to channel %s, which is not bridged", name)
+		return
+	}
+	channel, ok := models.Channels.Lookup(name)
+	if !ok {
+		clog.Warning("MQTT: Ignoring write to unknown channel %s", name)
+		return
+	}
+	// payloads of untyped channels are passed as is, others are decoded from text
+	if channelType, _ := models.Channels.GetType(channel); channelType != models.CHANNEL_TYPE_NONE {
+		if err := models.Channels.PublishValue(channel, string(msg.Payload())); err != nil {
+			clog.Warning("MQTT: Failed to publish '%s' to channel %s: %s", string(msg.Payload()), name, err.Error())
+		}
+	} else if !models.Channels.Publish(channel, msg.Payload()) {
+		clog.Warning("MQTT: Failed to publish %d bytes to channel %s", len(msg.Payload()), name)
+	}
+}
+
+// Run forwards channel updates to the broker until ctx is cancelled, and then
+// disconnects from it.
+func (mt *MqttTask) Run(ctx context.Context) {
+	ticker := time.NewTicker(MQTT_SUBSCRIBE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		var m *models.Message
+
+		select {
+		case <-ctx.Done():
+			// the port is read until it is destroyed, so that senders
+			// cannot block
+			go func() {
+				for range mt.Port.Input {
+				}
+			}()
+			models.PortManager.DestroyPort(mt.Port)
+			mt.Client.Disconnect(MQTT_DISCONNECT_QUIESCE)
+			clog.Info("MQTT: Disconnected from %s", mt.Options.Broker)
+			return
+		case m = <-mt.Port.Input:
+		case <-ticker.C:
+			mt.subscribeChannels()
+			continue
+		}
+
+		if m.Id.IsSystem() {
+			// a node registered a channel
+			if m.Id.GetSysParam() == 0 {
+				mt.subscribeChannels()
+			}
+			continue
+		}
+
+		name, ok := models.Channels.GetName(m.Id.GetChannel())
+		if !ok || !mt.isBridged(name) {
+			continue
+		}
+		payload := m.Data
+		if channelType, _ := models.Channels.GetType(m.Id.GetChannel()); channelType != models.CHANNEL_TYPE_NONE {
+			text, err := channelType.Format(m.Data)
+			if err != nil {
+				clog.Warning("MQTT: Not forwarding value of channel %s: %s", name, err.Error())
+				continue
+			}
+			payload = []byte(text)
+		}
+		topic := mt.Options.Prefix + "/" + name
+		token := mt.Client.Publish(topic, mt.Options.Qos, mt.Options.Retain, payload)
+		go func() {
+			if token.Wait() && token.Error() != nil {
+				clog.Warning("MQTT: Failed to publish to %s: %s", topic, token.Error().Error())
+			}
+		}()
+	}
+}
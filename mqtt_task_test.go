@@ -0,0 +1,376 @@
+package nocan
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"io"
+	"net"
+	"pannetrat.com/nocan/clog"
+	"pannetrat.com/nocan/models"
+	"sync"
+	"testing"
+	"time"
+)
+
+const TEST_TIMEOUT = 10 * time.Second
+
+func TestMatchTopicFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		name   string
+		match  bool
+	}{
+		{"kitchen/temperature", "kitchen/temperature", true},
+		{"kitchen/temperature", "kitchen/humidity", false},
+		{"kitchen/temperature", "kitchen/temperature/set", false},
+		{"kitchen/temperature/set", "kitchen/temperature", false},
+		{"kitchen/+", "kitchen/temperature", true},
+		{"kitchen/+", "kitchen", false},
+		{"kitchen/+", "kitchen/oven/temperature", false},
+		{"+/temperature", "garage/temperature", true},
+		{"+/+", "garage/temperature", true},
+		{"kitchen/#", "kitchen/temperature", true},
+		{"kitchen/#", "kitchen/oven/temperature", true},
+		{"kitchen/#", "garage/temperature", false},
+		{"#", "anything/at/all", true},
+		{"+", "temperature", true},
+		{"+", "kitchen/temperature", false},
+		{"", "", true},
+	}
+
+	for _, test := range tests {
+		if match := matchTopicFilter(test.filter, test.name); match != test.match {
+			t.Errorf("matchTopicFilter(%q, %q) = %t, expected %t", test.filter, test.name, match, test.match)
+		}
+	}
+}
+
+func TestIsBridged(t *testing.T) {
+	all := &MqttTask{}
+	some := &MqttTask{Options: MqttOptions{Channels: []string{"kitchen/#", "+/status"}}}
+
+	tests := []struct {
+		name      string
+		all, some bool
+	}{
+		{"kitchen/temperature", true, true},
+		{"garage/status", true, true},
+		{"garage/temperature", true, false},
+	}
+	for _, test := range tests {
+		if bridged := all.isBridged(test.name); bridged != test.all {
+			t.Errorf("Channel %s bridged without filters: %t, expected %t", test.name, bridged, test.all)
+		}
+		if bridged := some.isBridged(test.name); bridged != test.some {
+			t.Errorf("Channel %s bridged with filters: %t, expected %t", test.name, bridged, test.some)
+		}
+	}
+}
+
+// testBroker is a minimal in-process MQTT 3.1.1 broker: it only handles
+// QoS 0 and does not retain messages.
+type testBroker struct {
+	listener      net.Listener
+	mutex         sync.Mutex
+	subscriptions map[*brokerClient][]string
+}
+
+type brokerClient struct {
+	conn  net.Conn
+	mutex sync.Mutex // serializes writes
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := &testBroker{listener: listener, subscriptions: make(map[*brokerClient][]string)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go broker.serve(&brokerClient{conn: conn})
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return broker
+}
+
+func (broker *testBroker) Address() string {
+	return "tcp://" + broker.listener.Addr().String()
+}
+
+// Subscribed tells if a client subscribed to exactly this filter.
+func (broker *testBroker) Subscribed(filter string) bool {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+
+	for _, filters := range broker.subscriptions {
+		for _, f := range filters {
+			if f == filter {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (client *brokerClient) write(header byte, body []byte) error {
+	var length [binary.MaxVarintLen32]byte
+
+	n := 0
+	remaining := len(body)
+	for {
+		length[n] = byte(remaining % 128)
+		remaining /= 128
+		if remaining > 0 {
+			length[n] |= 0x80
+		}
+		n++
+		if remaining == 0 {
+			break
+		}
+	}
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	_, err := client.conn.Write(append(append([]byte{header}, length[:n]...), body...))
+	return err
+}
+
+func readPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7F) * multiplier
+		multiplier *= 128
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+func readString(body []byte) (string, []byte) {
+	if len(body) < 2 {
+		return "", nil
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+n {
+		return "", nil
+	}
+	return string(body[2 : 2+n]), body[2+n:]
+}
+
+func (broker *testBroker) serve(client *brokerClient) {
+	defer func() {
+		broker.mutex.Lock()
+		delete(broker.subscriptions, client)
+		broker.mutex.Unlock()
+		client.conn.Close()
+	}()
+
+	r := bufio.NewReader(client.conn)
+	for {
+		header, body, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		switch header >> 4 {
+		case 1: // CONNECT
+			client.write(0x20, []byte{0, 0})
+		case 3: // PUBLISH
+			topic, payload := readString(body)
+			broker.publish(topic, payload)
+		case 8: // SUBSCRIBE
+			var filter string
+			var granted []byte
+			rest := body[2:]
+			for len(rest) > 0 {
+				filter, rest = readString(rest)
+				if len(rest) == 0 {
+					return
+				}
+				rest = rest[1:]
+				broker.mutex.Lock()
+				broker.subscriptions[client] = append(broker.subscriptions[client], filter)
+				broker.mutex.Unlock()
+				granted = append(granted, 0)
+			}
+			client.write(0x90, append(body[:2:2], granted...))
+		case 12: // PINGREQ
+			client.write(0xD0, nil)
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+func (broker *testBroker) publish(topic string, payload []byte) {
+	var clients []*brokerClient
+
+	broker.mutex.Lock()
+	for client, filters := range broker.subscriptions {
+		for _, filter := range filters {
+			if matchTopicFilter(filter, topic) {
+				clients = append(clients, client)
+				break
+			}
+		}
+	}
+	broker.mutex.Unlock()
+
+	body := make([]byte, 2, 2+len(topic)+len(payload))
+	binary.BigEndian.PutUint16(body, uint16(len(topic)))
+	body = append(append(body, topic...), payload...)
+	for _, client := range clients {
+		client.write(0x30, body)
+	}
+}
+
+type received struct {
+	topic   string
+	payload string
+}
+
+// testClient connects to the broker and collects the messages of the topics
+// matching filter.
+func testClient(t *testing.T, broker *testBroker, filter string) (mqtt.Client, chan received) {
+	messages := make(chan received, 16)
+
+	opts := mqtt.NewClientOptions().AddBroker(broker.Address()).SetClientID("nocan-test-client")
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); !token.WaitTimeout(TEST_TIMEOUT) || token.Error() != nil {
+		t.Fatalf("Test client failed to connect: %v", token.Error())
+	}
+	t.Cleanup(func() { client.Disconnect(0) })
+	token := client.Subscribe(filter, 0, func(_ mqtt.Client, msg mqtt.Message) {
+		messages <- received{msg.Topic(), string(msg.Payload())}
+	})
+	if !token.WaitTimeout(TEST_TIMEOUT) || token.Error() != nil {
+		t.Fatalf("Test client failed to subscribe: %v", token.Error())
+	}
+	return client, messages
+}
+
+func expectMessage(t *testing.T, messages chan received, topic string, payload string) {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		if msg.topic != topic || msg.payload != payload {
+			t.Errorf("Received %q on %s, expected %q on %s", msg.payload, msg.topic, payload, topic)
+		}
+	case <-time.After(TEST_TIMEOUT):
+		t.Fatalf("Nothing was published to %s", topic)
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(TEST_TIMEOUT)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMqttBridge(t *testing.T) {
+	clog.SetLevel(clog.WARNING)
+
+	// the models read the messages sent to their ports, as when running
+	modelCtx, stopModels := context.WithCancel(context.Background())
+	defer stopModels()
+	go models.Channels.Run(modelCtx)
+	go models.Nodes.Run(modelCtx)
+
+	level, err := models.Channels.Declare("mqtt-test/level", models.CHANNEL_TYPE_INT16BE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := models.Channels.Register("mqtt-test/raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := models.Channels.Register("other/level")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broker := newTestBroker(t)
+	task, err := NewMqttTask(nil, MqttOptions{
+		Broker:   broker.Address(),
+		ClientId: "nocan-test",
+		Prefix:   "nocan/",
+		Channels: []string{"mqtt-test/#"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		task.Run(ctx)
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	waitFor(t, "subscriptions", func() bool {
+		return broker.Subscribed("nocan/mqtt-test/level/set") && broker.Subscribed("nocan/mqtt-test/raw/set")
+	})
+	if broker.Subscribed("nocan/other/level/set") || broker.Subscribed("nocan/#") {
+		t.Errorf("The task subscribed to topics of channels that are not bridged")
+	}
+
+	client, messages := testClient(t, broker, "nocan/+/+")
+
+	// from the bus to MQTT, with typed values formatted as text
+	models.Channels.Publish(other, []byte{1})
+	if err := models.Channels.PublishValue(level, "-2"); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, messages, "nocan/mqtt-test/level", "-2")
+	models.Channels.Publish(raw, []byte{0, 0xFF})
+	expectMessage(t, messages, "nocan/mqtt-test/raw", "\x00\xFF")
+
+	// from MQTT to the bus, with typed values parsed from text and others
+	// passed as is
+	client.Publish("nocan/mqtt-test/level/set", 0, false, "513")
+	expectMessage(t, messages, "nocan/mqtt-test/level", "513")
+	if content, _ := models.Channels.GetContent(level); string(content) != "\x02\x01" {
+		t.Errorf("Channel mqtt-test/level holds %x, expected 0201", content)
+	}
+	client.Publish("nocan/mqtt-test/level/set", 0, false, "not a number")
+	client.Publish("nocan/mqtt-test/raw/set", 0, false, []byte{1, 2, 3})
+	expectMessage(t, messages, "nocan/mqtt-test/raw", "\x01\x02\x03")
+	if content, _ := models.Channels.GetContent(level); string(content) != "\x02\x01" {
+		t.Errorf("An invalid value changed channel mqtt-test/level to %x", content)
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(TEST_TIMEOUT):
+		t.Fatalf("The task did not stop")
+	}
+	if task.Client.IsConnected() {
+		t.Errorf("The task is still connected after stopping")
+	}
+}
@@ -0,0 +1,287 @@
+package simulator
+
+import (
+	"fmt"
+	"pannetrat.com/nocan/clog"
+	"pannetrat.com/nocan/models"
+	"sync"
+	"time"
+)
+
+const TICK_INTERVAL = 100 * time.Millisecond
+
+func init() {
+	models.RegisterTransport("sim", func(address string) (models.Transport, error) {
+		var config *Config
+		var err error
+
+		if address == "" {
+			config = DefaultConfig()
+		} else if config, err = LoadConfig(address); err != nil {
+			return nil, err
+		}
+		return NewBus(config)
+	})
+}
+
+// Bus is an in-process NoCAN bus populated with virtual nodes. It implements
+// models.Transport by emulating the serial interface protocol, so it can be
+// used wherever a physical interface is expected (e.g. --interface sim:nodes.yaml).
+type Bus struct {
+	Mutex    sync.Mutex
+	Nodes    []*VirtualNode
+	PowerOn  bool
+	output   chan []byte
+	input    chan *models.Message
+	power    chan bool
+	assembly map[models.Node]*models.Message
+	running  bool
+}
+
+type busMessage struct {
+	from *VirtualNode
+	m    *models.Message
+}
+
+func NewBus(config *Config) (*Bus, error) {
+	bus := &Bus{
+		PowerOn:  true,
+		output:   make(chan []byte, 256),
+		input:    make(chan *models.Message, 16),
+		power:    make(chan bool, 1),
+		assembly: make(map[models.Node]*models.Message),
+	}
+	for _, nc := range config.Nodes {
+		vn, err := NewVirtualNode(nc)
+		if err != nil {
+			return nil, fmt.Errorf("Incorrect simulated node udid '%s': %s", nc.Udid, err.Error())
+		}
+		bus.Nodes = append(bus.Nodes, vn)
+	}
+	return bus, nil
+}
+
+// Open starts the bus the first time it is called. Reopening after Close()
+// keeps the state of the virtual nodes, as a physical bus would.
+func (bus *Bus) Open() error {
+	bus.Mutex.Lock()
+	defer bus.Mutex.Unlock()
+
+	if !bus.running {
+		bus.running = true
+		now := time.Now()
+		for _, vn := range bus.Nodes {
+			vn.Boot(now)
+		}
+		go bus.run()
+		clog.Info("SIM: Started simulated bus with %d nodes", len(bus.Nodes))
+	}
+	return nil
+}
+
+// ReceivedValue returns the last value of a channel received by the virtual
+// node with the given udid, if it is subscribed to it.
+func (bus *Bus) ReceivedValue(udid [8]byte, name string) ([]byte, bool) {
+	bus.Mutex.Lock()
+	defer bus.Mutex.Unlock()
+
+	for _, vn := range bus.Nodes {
+		if vn.Udid != udid {
+			continue
+		}
+		channel, ok := vn.Channels[name]
+		if !ok {
+			return nil, false
+		}
+		value, ok := vn.Values[channel]
+		return append([]byte(nil), value...), ok
+	}
+	return nil, false
+}
+
+func (bus *Bus) Close() {
+	clog.Debug("SIM: Closing simulated interface")
+}
+
+func (bus *Bus) Status() (int, bool) {
+	return 0, true
+}
+
+func (bus *Bus) Read(p []byte) (int, error) {
+	packet := <-bus.output
+	return copy(p, packet), nil
+}
+
+func (bus *Bus) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, fmt.Errorf("Simulated write: frame is empty")
+	}
+
+	switch p[0] {
+	case models.SERIAL_HEADER_PACKET:
+		var frame models.CanFrame
+
+		if err := frame.UnmarshalBinary(p); err != nil {
+			return 0, err
+		}
+		bus.respond(models.SERIAL_HEADER_SUCCESS)
+		bus.assembleFrame(&frame)
+	case models.SERIAL_HEADER_REQUEST_SOFT_RESET, models.SERIAL_HEADER_REQUEST_HARD_RESET,
+		models.SERIAL_HEADER_SET_CAN_RES, models.SERIAL_HEADER_VERSION:
+		bus.respond(models.SERIAL_HEADER_SUCCESS)
+	case models.SERIAL_HEADER_REQUEST_POWER_STATUS:
+		bus.respond(bus.powerStatus()...)
+	case models.SERIAL_HEADER_SET_POWER:
+		if len(p) < 2 {
+			bus.respond(models.SERIAL_HEADER_FAIL)
+			break
+		}
+		bus.power <- (p[1] == models.INTERFACE_POWER_ON)
+		bus.respond(models.SERIAL_HEADER_SUCCESS)
+	default:
+		bus.respond(models.SERIAL_HEADER_COMMAND_UNKNOWN)
+	}
+	return len(p), nil
+}
+
+func (bus *Bus) respond(packet ...byte) {
+	bus.output <- packet
+}
+
+func (bus *Bus) powerStatus() []byte {
+	// A nominal 12V supply, as seen by an interface powered with a 5V USB reference
+	var flags byte
+	var powerlevel, senselevel uint16
+	var usbref uint16 = 225
+
+	bus.Mutex.Lock()
+	defer bus.Mutex.Unlock()
+
+	powerlevel = 349
+	if bus.PowerOn {
+		flags = models.POWER_FLAGS_SUPPLY | models.POWER_FLAGS_SENSE
+		senselevel = 1023
+	} else {
+		flags = models.POWER_FLAGS_SUPPLY
+	}
+	return []byte{models.SERIAL_HEADER_SUCCESS | 7, flags,
+		byte(powerlevel >> 8), byte(powerlevel),
+		byte(senselevel >> 8), byte(senselevel),
+		byte(usbref >> 8), byte(usbref)}
+}
+
+func (bus *Bus) setPower(on bool, now time.Time) {
+	if on == bus.PowerOn {
+		return
+	}
+	bus.PowerOn = on
+	for _, vn := range bus.Nodes {
+		if on {
+			vn.Boot(now)
+		} else {
+			vn.PowerOff()
+		}
+	}
+}
+
+// assembleFrame rebuilds messages sent by the manager from their CAN frames.
+// It is only called from Write(), which is never called concurrently.
+func (bus *Bus) assembleFrame(frame *models.CanFrame) {
+	node := frame.CanId.GetNode()
+
+	if frame.CanId.IsFirst() {
+		bus.assembly[node] = models.NewMessageFromFrame(frame)
+	} else if bus.assembly[node] != nil {
+		bus.assembly[node].AppendData(frame.CanData[:frame.CanDlc])
+	} else {
+		clog.Warning("SIM: Got frame with missing first bit indicator, discarding.")
+		return
+	}
+	if frame.CanId.IsLast() {
+		bus.input <- bus.assembly[node]
+		delete(bus.assembly, node)
+	}
+}
+
+// sendMessage splits a message from a virtual node into CAN frames for the
+// manager, and also delivers it to the other virtual nodes on the bus.
+func (bus *Bus) sendMessage(from *VirtualNode, m *models.Message, now time.Time) []busMessage {
+	var frame models.CanFrame
+	var replies []busMessage
+
+	pos := 0
+	for {
+		frame.CanId = (m.Id & models.CANID_MASK_MESSAGE) | models.CANID_MASK_EXTENDED
+		if pos == 0 {
+			frame.CanId |= models.CANID_MASK_FIRST
+		}
+		if len(m.Data)-pos <= 8 {
+			frame.CanId |= models.CANID_MASK_LAST
+			frame.CanDlc = uint8(len(m.Data) - pos)
+		} else {
+			frame.CanDlc = 8
+		}
+		frame.CanData = [8]uint8{}
+		copy(frame.CanData[:], m.Data[pos:pos+int(frame.CanDlc)])
+		packet, _ := frame.MarshalBinary()
+		bus.output <- packet
+		pos += int(frame.CanDlc)
+		if pos >= len(m.Data) {
+			break
+		}
+	}
+
+	for _, vn := range bus.Nodes {
+		if vn != from {
+			replies = appendMessages(replies, vn, vn.Handle(m, now))
+		}
+	}
+	return replies
+}
+
+func appendMessages(queue []busMessage, from *VirtualNode, messages []*models.Message) []busMessage {
+	for _, m := range messages {
+		queue = append(queue, busMessage{from, m})
+	}
+	return queue
+}
+
+// dispatch sends messages from virtual nodes, as well as the replies they
+// trigger from other virtual nodes, in order.
+func (bus *Bus) dispatch(queue []busMessage, now time.Time) {
+	for len(queue) > 0 {
+		bm := queue[0]
+		queue = append(queue[1:], bus.sendMessage(bm.from, bm.m, now)...)
+	}
+}
+
+func (bus *Bus) run() {
+	ticker := time.NewTicker(TICK_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case m := <-bus.input:
+			var queue []busMessage
+			now := time.Now()
+			bus.Mutex.Lock()
+			for _, vn := range bus.Nodes {
+				queue = appendMessages(queue, vn, vn.Handle(m, now))
+			}
+			bus.dispatch(queue, now)
+			bus.Mutex.Unlock()
+		case on := <-bus.power:
+			bus.Mutex.Lock()
+			bus.setPower(on, time.Now())
+			bus.Mutex.Unlock()
+		case now := <-ticker.C:
+			var queue []busMessage
+			bus.Mutex.Lock()
+			for _, vn := range bus.Nodes {
+				queue = appendMessages(queue, vn, vn.Tick(now))
+			}
+			bus.dispatch(queue, now)
+			bus.Mutex.Unlock()
+		}
+	}
+}
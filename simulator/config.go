@@ -0,0 +1,67 @@
+package simulator
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"time"
+)
+
+const (
+	DEFAULT_FLASH_SIZE  = 0x8000
+	DEFAULT_EEPROM_SIZE = 0x400
+	DEFAULT_SIGNATURE   = "1e950f" // ATmega328P
+
+	// a bootloader left without any request starts the application again
+	DEFAULT_BOOTLOADER_TIMEOUT = 10 * time.Second
+)
+
+type PublishConfig struct {
+	Channel  string        `yaml:"channel"`
+	Value    string        `yaml:"value"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+type NodeConfig struct {
+	Udid              string          `yaml:"udid"`
+	FlashSize         uint32          `yaml:"flash_size"`
+	EepromSize        uint32          `yaml:"eeprom_size"`
+	Signature         string          `yaml:"signature"` // in hexadecimal, as returned by the bootloader
+	BootloaderTimeout time.Duration   `yaml:"bootloader_timeout"`
+	Channels          []string        `yaml:"channels"`
+	Subscriptions     []string        `yaml:"subscriptions"`
+	Publish           []PublishConfig `yaml:"publish"`
+}
+
+type Config struct {
+	Nodes []NodeConfig `yaml:"nodes"`
+}
+
+// DefaultConfig describes the bus used when no configuration file is given
+// (e.g. --interface sim://): a single node registering one channel.
+func DefaultConfig() *Config {
+	return &Config{
+		Nodes: []NodeConfig{
+			{
+				Udid:     "01:02:03:04:05:06:07:08",
+				Channels: []string{"sim/status"},
+			},
+		},
+	}
+}
+
+func LoadConfig(filename string) (*Config, error) {
+	var config Config
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err = yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("YAML parsing error in %s: %s", filename, err.Error())
+	}
+	if len(config.Nodes) == 0 {
+		return nil, fmt.Errorf("No nodes are defined in %s", filename)
+	}
+	return &config, nil
+}
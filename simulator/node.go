@@ -0,0 +1,316 @@
+package simulator
+
+import (
+	"encoding/hex"
+	"fmt"
+	"pannetrat.com/nocan/clog"
+	"pannetrat.com/nocan/models"
+	"time"
+)
+
+const (
+	NODE_STATE_OFF = iota
+	NODE_STATE_ADDRESSING
+	NODE_STATE_REGISTERING
+	NODE_STATE_RUNNING
+	NODE_STATE_BOOTLOADER
+)
+
+const RETRY_INTERVAL = 1 * time.Second
+
+// VirtualNode emulates the firmware of a NoCAN node: address allocation,
+// channel registration and subscription, pings and the bootloader.
+type VirtualNode struct {
+	Config        NodeConfig
+	Udid          [8]byte
+	Id            models.Node
+	State         int
+	Channels      map[string]models.Channel
+	Subscriptions map[models.Channel]string
+	Values        map[models.Channel][]byte
+	Flash         []byte
+	Eeprom        []byte
+	registering   string
+	nextAction    time.Time
+	nextPublish   []time.Time
+	memtype       byte
+	address       uint32
+	page          []byte
+	signature     []byte
+}
+
+func NewVirtualNode(config NodeConfig) (*VirtualNode, error) {
+	vn := &VirtualNode{Config: config}
+
+	if err := models.StringToUdid(config.Udid, vn.Udid[:]); err != nil {
+		return nil, err
+	}
+	if vn.Config.FlashSize == 0 {
+		vn.Config.FlashSize = DEFAULT_FLASH_SIZE
+	}
+	if vn.Config.EepromSize == 0 {
+		vn.Config.EepromSize = DEFAULT_EEPROM_SIZE
+	}
+	if vn.Config.BootloaderTimeout <= 0 {
+		vn.Config.BootloaderTimeout = DEFAULT_BOOTLOADER_TIMEOUT
+	}
+	if vn.Config.Signature == "" {
+		vn.Config.Signature = DEFAULT_SIGNATURE
+	}
+	signature, err := hex.DecodeString(vn.Config.Signature)
+	if err != nil || len(signature) > 8 {
+		return nil, fmt.Errorf("Incorrect signature '%s' for node %s", vn.Config.Signature, config.Udid)
+	}
+	vn.signature = signature
+	vn.Flash = erasedMemory(vn.Config.FlashSize)
+	vn.Eeprom = erasedMemory(vn.Config.EepromSize)
+	vn.nextPublish = make([]time.Time, len(config.Publish))
+	return vn, nil
+}
+
+func erasedMemory(size uint32) []byte {
+	mem := make([]byte, size)
+	for i := range mem {
+		mem[i] = 0xFF
+	}
+	return mem
+}
+
+func (vn *VirtualNode) String() string {
+	return models.UdidToString(vn.Udid[:])
+}
+
+// Boot restarts the node, which then asks for an address.
+func (vn *VirtualNode) Boot(now time.Time) {
+	vn.Id = 0
+	vn.State = NODE_STATE_ADDRESSING
+	vn.Channels = make(map[string]models.Channel)
+	vn.Subscriptions = make(map[models.Channel]string)
+	vn.Values = make(map[models.Channel][]byte)
+	vn.registering = ""
+	vn.nextAction = now
+}
+
+func (vn *VirtualNode) PowerOff() {
+	vn.State = NODE_STATE_OFF
+}
+
+// pendingChannel returns the next channel that needs to be registered, or an
+// empty string once all channels and subscriptions are known.
+func (vn *VirtualNode) pendingChannel() string {
+	for _, name := range vn.Config.Channels {
+		if _, ok := vn.Channels[name]; !ok {
+			return name
+		}
+	}
+	for _, name := range vn.Config.Subscriptions {
+		if _, ok := vn.Channels[name]; !ok {
+			return name
+		}
+	}
+	return ""
+}
+
+func (vn *VirtualNode) register(now time.Time) []*models.Message {
+	vn.registering = vn.pendingChannel()
+	if vn.registering == "" {
+		vn.State = NODE_STATE_RUNNING
+		for i := range vn.nextPublish {
+			vn.nextPublish[i] = now.Add(vn.Config.Publish[i].Interval)
+		}
+		clog.Info("SIM: Node %s is running as node %d", vn, vn.Id)
+		return nil
+	}
+	vn.nextAction = now.Add(RETRY_INTERVAL)
+	return []*models.Message{models.NewSystemMessage(vn.Id, models.NOCAN_SYS_CHANNEL_REGISTER, 0, []byte(vn.registering))}
+}
+
+// Tick performs the periodic actions of the node: retrying requests that got
+// no answer, sending scripted publications and leaving an idle bootloader.
+func (vn *VirtualNode) Tick(now time.Time) []*models.Message {
+	var out []*models.Message
+
+	switch vn.State {
+	case NODE_STATE_ADDRESSING:
+		if !now.Before(vn.nextAction) {
+			vn.nextAction = now.Add(RETRY_INTERVAL)
+			out = append(out, models.NewSystemMessage(0, models.NOCAN_SYS_ADDRESS_REQUEST, 0, vn.Udid[:]))
+		}
+	case NODE_STATE_REGISTERING:
+		if !now.Before(vn.nextAction) {
+			out = append(out, vn.register(now)...)
+		}
+	case NODE_STATE_BOOTLOADER:
+		if !now.Before(vn.nextAction) {
+			clog.Info("SIM: Node %d bootloader timed out, starting application", vn.Id)
+			vn.Boot(now)
+		}
+	case NODE_STATE_RUNNING:
+		for i, publish := range vn.Config.Publish {
+			if publish.Interval <= 0 || now.Before(vn.nextPublish[i]) {
+				continue
+			}
+			vn.nextPublish[i] = now.Add(publish.Interval)
+			if channel, ok := vn.Channels[publish.Channel]; ok {
+				out = append(out, models.NewPublishMessage(vn.Id, channel, publishValue(publish.Value)))
+			}
+		}
+	}
+	return out
+}
+
+func publishValue(value string) []byte {
+	if len(value) > 1 && value[0] == '#' {
+		if data, err := hex.DecodeString(value[1:]); err == nil {
+			return data
+		}
+	}
+	return []byte(value)
+}
+
+// Handle processes a message seen on the bus and returns the node's replies.
+func (vn *VirtualNode) Handle(m *models.Message, now time.Time) []*models.Message {
+	if vn.State == NODE_STATE_OFF {
+		return nil
+	}
+
+	if !m.Id.IsSystem() {
+		channel := m.Id.GetChannel()
+		if _, ok := vn.Subscriptions[channel]; ok && vn.State == NODE_STATE_RUNNING {
+			vn.Values[channel] = append([]byte(nil), m.Data...)
+			clog.Debug("SIM: Node %d received update for channel %s", vn.Id, vn.Subscriptions[channel])
+		}
+		return nil
+	}
+
+	fn := m.Id.GetSysFunc()
+	if fn == models.NOCAN_SYS_ADDRESS_CONFIGURE {
+		return vn.handleAddressConfigure(m, now)
+	}
+	if vn.Id == 0 || m.Id.GetNode() != vn.Id {
+		return nil
+	}
+
+	if vn.State == NODE_STATE_BOOTLOADER {
+		return vn.handleBootloader(m, now)
+	}
+
+	switch fn {
+	case models.NOCAN_SYS_NODE_PING:
+		return vn.reply(models.NOCAN_SYS_NODE_PING_ACK, 0, nil)
+	case models.NOCAN_SYS_NODE_BOOT_REQUEST:
+		reply := vn.reply(models.NOCAN_SYS_NODE_BOOT_ACK, 0, nil)
+		if m.Id.GetSysParam() == 0x01 {
+			clog.Info("SIM: Node %d entering bootloader", vn.Id)
+			vn.State = NODE_STATE_BOOTLOADER
+			vn.nextAction = now.Add(vn.Config.BootloaderTimeout)
+			vn.memtype = 'F'
+			vn.address = 0
+			vn.page = nil
+		} else {
+			vn.Boot(now)
+		}
+		return reply
+	case models.NOCAN_SYS_CHANNEL_REGISTER_ACK:
+		if vn.State != NODE_STATE_REGISTERING || vn.registering == "" {
+			return nil
+		}
+		if m.Id.GetSysParam() != 0 || len(m.Data) < 2 {
+			clog.Warning("SIM: Node %d failed to register channel %s", vn.Id, vn.registering)
+			return nil
+		}
+		channel := models.BytesToChannel(m.Data)
+		vn.Channels[vn.registering] = channel
+		var out []*models.Message
+		for _, name := range vn.Config.Subscriptions {
+			if name == vn.registering {
+				var channel_bytes [2]byte
+				models.ChannelToBytes(channel, channel_bytes[:])
+				vn.Subscriptions[channel] = name
+				out = append(out, models.NewSystemMessage(vn.Id, models.NOCAN_SYS_CHANNEL_SUBSCRIBE, 0, channel_bytes[:]))
+			}
+		}
+		return append(out, vn.register(now)...)
+	}
+	return nil
+}
+
+func (vn *VirtualNode) handleAddressConfigure(m *models.Message, now time.Time) []*models.Message {
+	if vn.State != NODE_STATE_ADDRESSING || len(m.Data) != 8 || string(m.Data) != string(vn.Udid[:]) {
+		return nil
+	}
+	node := m.Id.GetSysParam()
+	if node == 0 || node > 127 {
+		clog.Warning("SIM: Node %s was refused an address", vn)
+		return nil
+	}
+	vn.Id = models.Node(node)
+	vn.State = NODE_STATE_REGISTERING
+	vn.nextAction = now
+	clog.Info("SIM: Node %s was assigned node id %d", vn, vn.Id)
+	return vn.reply(models.NOCAN_SYS_ADDRESS_CONFIGURE_ACK, 0, nil)
+}
+
+func (vn *VirtualNode) memory() []byte {
+	if vn.memtype == 'E' {
+		return vn.Eeprom
+	}
+	return vn.Flash
+}
+
+func (vn *VirtualNode) handleBootloader(m *models.Message, now time.Time) []*models.Message {
+	vn.nextAction = now.Add(vn.Config.BootloaderTimeout)
+
+	switch m.Id.GetSysFunc() {
+	case models.NOCAN_SYS_BOOTLOADER_SET_ADDRESS:
+		if len(m.Data) != 4 {
+			return vn.reply(models.NOCAN_SYS_BOOTLOADER_SET_ADDRESS_ACK, 0xFF, nil)
+		}
+		vn.memtype = m.Id.GetSysParam()
+		vn.address = (uint32(m.Data[0]) << 24) | (uint32(m.Data[1]) << 16) | (uint32(m.Data[2]) << 8) | uint32(m.Data[3])
+		vn.page = nil
+		return vn.reply(models.NOCAN_SYS_BOOTLOADER_SET_ADDRESS_ACK, 0, nil)
+	case models.NOCAN_SYS_BOOTLOADER_WRITE:
+		if m.Id.GetSysParam() == 0 {
+			vn.page = append(vn.page, m.Data...)
+			return vn.reply(models.NOCAN_SYS_BOOTLOADER_WRITE_ACK, 0, nil)
+		}
+		mem := vn.memory()
+		if vn.address+uint32(len(vn.page)) > uint32(len(mem)) {
+			clog.Warning("SIM: Node %d write beyond end of memory at 0x%x", vn.Id, vn.address)
+			vn.page = nil
+			return vn.reply(models.NOCAN_SYS_BOOTLOADER_WRITE_ACK, 0xFF, nil)
+		}
+		copy(mem[vn.address:], vn.page)
+		vn.address += uint32(len(vn.page))
+		vn.page = nil
+		return vn.reply(models.NOCAN_SYS_BOOTLOADER_WRITE_ACK, 0, nil)
+	case models.NOCAN_SYS_BOOTLOADER_READ:
+		mem := vn.memory()
+		rlen := uint32(m.Id.GetSysParam())
+		if rlen > 8 || vn.address+rlen > uint32(len(mem)) {
+			return vn.reply(models.NOCAN_SYS_BOOTLOADER_READ_ACK, 0xFF, nil)
+		}
+		data := mem[vn.address : vn.address+rlen]
+		vn.address += rlen
+		return vn.reply(models.NOCAN_SYS_BOOTLOADER_READ_ACK, 0, data)
+	case models.NOCAN_SYS_BOOTLOADER_GET_SIGNATURE:
+		return vn.reply(models.NOCAN_SYS_BOOTLOADER_GET_SIGNATURE_ACK, 0, vn.signature)
+	case models.NOCAN_SYS_NODE_BOOT_REQUEST:
+		// Restart the bootloader session
+		vn.memtype = 'F'
+		vn.address = 0
+		vn.page = nil
+		return vn.reply(models.NOCAN_SYS_NODE_BOOT_ACK, 0, nil)
+	case models.NOCAN_SYS_BOOTLOADER_LEAVE:
+		clog.Info("SIM: Node %d leaving bootloader", vn.Id)
+		reply := vn.reply(models.NOCAN_SYS_BOOTLOADER_LEAVE_ACK, 0, nil)
+		vn.Boot(now)
+		return reply
+	}
+	return nil
+}
+
+func (vn *VirtualNode) reply(fn uint8, param uint8, data []byte) []*models.Message {
+	return []*models.Message{models.NewSystemMessage(vn.Id, fn, param, data)}
+}
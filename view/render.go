@@ -10,6 +10,9 @@ import (
 	"pannetrat.com/nocan/clog"
 )
 
+// ViewDir is the directory holding the Ace templates.
+var ViewDir = "../view"
+
 /** CONTEXT **/
 
 type Context struct {
@@ -172,7 +175,7 @@ func RenderAceTemplate(w http.ResponseWriter, base string, template string, cont
 		LogHttpError(w, err.Error(), http.StatusInternalServerError)
 		return false
 	}
-	tpl, err := ace.Load(base, template, &ace.Options{BaseDir: "../view", Indent: "  ", DynamicReload: true})
+	tpl, err := ace.Load(base, template, &ace.Options{BaseDir: ViewDir, Indent: "  ", DynamicReload: true})
 	if err != nil {
 		LogHttpError(w, err.Error(), http.StatusInternalServerError)
 		return false